@@ -12,15 +12,20 @@ var (
 
 	commands = []*cadet.Command{
 		&cadet.Command{
-			Use:   "ls",
+			Use:   "ls [-name s] [-glob pattern] [-regex re] [-tag t]... [-min-size n] [-max-size n] [-sort key] [-limit n] [-cursor c]",
 			Short: "List files",
 			Run:   onLs,
 		},
 		&cadet.Command{
-			Use:   "get",
-			Short: "Download a file",
+			Use:   "get [-q] [-o path] [-C dir] [-force] [-inflight n] [-peer-inflight n] [-j n] [-timeout d] id...",
+			Short: "Download files",
 			Run:   onGet,
 		},
+		&cadet.Command{
+			Use:   "cat [-offset n] [-length n] [-timeout d] id",
+			Short: "Print a byte range of a file",
+			Run:   onCat,
+		},
 		&cadet.Command{
 			Use:   "tracker",
 			Short: "Set/get tracker address",
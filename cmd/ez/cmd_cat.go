@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/aburdulescu/ez/cmn"
+	"github.com/aburdulescu/ez/ezt"
+	"github.com/aburdulescu/ez/swp"
+)
+
+func onCat(args []string) error {
+	fs := flag.NewFlagSet("cat", flag.ContinueOnError)
+	offset := fs.Int64("offset", 0, "offset of the first byte")
+	length := fs.Int64("length", -1, "number of bytes, -1 for the rest of the file")
+	fs.DurationVar(&fTimeout, "timeout", OP_TIMEOUT, "max time to wait for each answer of a peer, 0 to wait forever")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return fmt.Errorf("id wasn't provided")
+	}
+	if fTimeout < 0 {
+		return fmt.Errorf("timeout can't be negative")
+	}
+	id := fs.Arg(0)
+	trackerURL, err := getTrackerURL()
+	if err != nil {
+		return err
+	}
+	trackerClient := ezt.NewClient(trackerURL)
+	rsp, err := trackerClient.Get(ezt.GetRequest{Id: id})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	size := rsp.IFile.Size
+	if *offset < 0 || *offset > size {
+		return fmt.Errorf("offset must be between 0 and %d", size)
+	}
+	end := size
+	if *length >= 0 && *length < size-*offset {
+		end = *offset + *length
+	}
+	client, err := dialRangePeer(id, rsp.Peers)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	defer client.Disconnect()
+	checksums := trustedChecksums(trackerClient, client, id, size)
+	if checksums == nil {
+		log.Printf("no checksums match id %s, the data is only checked against what the peer claims", id)
+	}
+	return catRange(os.Stdout, client, checksums, size, *offset, end)
+}
+
+// catRange writes the bytes of the file from offset to end to w. Every range
+// is received in memory and checked before it's written, since nothing
+// written to w can be taken back. If the checksums proven by the id are
+// known, whole chunks are requested, so that they can be checked against
+// them and not only against the checksum sent by the peer.
+func catRange(w io.Writer, client *SeederClient, checksums []cmn.Checksum, size, offset, end int64) error {
+	buf := AllocChunk()
+	defer ReleaseChunk(buf)
+	for off := offset; off < end; {
+		start, n := off, end-off
+		if checksums != nil {
+			start = off / cmn.ChunkSize * cmn.ChunkSize
+			n = size - start
+		}
+		if n > cmn.ChunkSize {
+			n = cmn.ChunkSize
+		}
+		rb := bytes.NewBuffer(buf[:0])
+		got, err := client.Getrange(context.Background(), uint64(start), uint64(n), rb)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		data := rb.Bytes()
+		if checksums != nil {
+			index := start / cmn.ChunkSize
+			if got != n || cmn.NewChecksum(data) != checksums[index] {
+				return fmt.Errorf("chunk %d differs from the one proven by the id", index)
+			}
+		}
+		data = data[off-start:]
+		if int64(len(data)) > end-off {
+			data = data[:end-off]
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("file ended at %d, expected %d bytes", off, size)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		off += int64(len(data))
+	}
+	return nil
+}
+
+// trustedChecksums returns the checksums of the chunks of the file, from its
+// manifest or from the peer, if they match the id, otherwise nil.
+func trustedChecksums(trackerClient ezt.Client, client *SeederClient, id string, size int64) []cmn.Checksum {
+	m, err := trackerClient.GetManifest(ezt.GetManifestRequest{Id: id})
+	if err == nil && m.Verify(id) == nil && m.ChunkSize == cmn.ChunkSize && m.Size == size {
+		return m.Checksums
+	}
+	if !client.Proto().Caps.Has(swp.CapChecksums) {
+		return nil
+	}
+	checksums, err := client.Getchecksums(chunkCount(size))
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if cmn.NewID(checksums) != id {
+		log.Printf("checksums from the peer don't match id %s", id)
+		return nil
+	}
+	return checksums
+}
+
+// dialRangePeer connects to the first peer which can serve byte ranges of
+// the file.
+func dialRangePeer(id string, peers []string) (*SeederClient, error) {
+	for _, peer := range peers {
+		client, err := DialSeederClient(peer)
+		if err != nil {
+			continue
+		}
+		if !client.Proto().Caps.Has(swp.CapRange) {
+			log.Printf("%s doesn't support GETRANGE", peer)
+			client.Close()
+			continue
+		}
+		if err := client.Connect(id); err != nil {
+			log.Println(err)
+			client.Close()
+			continue
+		}
+		return client, nil
+	}
+	return nil, fmt.Errorf("no peer can serve ranges of %s", id)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aburdulescu/ez/cmn"
+	"github.com/aburdulescu/ez/swp"
+)
+
+func TestCatRange(t *testing.T) {
+	fQuiet = true
+	s := newFakeSeeder(t, 2*cmn.ChunkSize+1000)
+	s.caps |= swp.CapRange
+	size := int64(len(s.data))
+
+	cat := func(t *testing.T, checksums []cmn.Checksum, offset, end int64) ([]byte, error) {
+		c, err := s.Dial("peer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		var out bytes.Buffer
+		err = catRange(&out, c, checksums, size, offset, end)
+		return out.Bytes(), err
+	}
+
+	ranges := [][2]int64{
+		{0, size},
+		{100, 200},
+		{cmn.ChunkSize - 10, cmn.ChunkSize + 10},
+		{cmn.ChunkSize + 1, size},
+	}
+	for _, checksums := range [][]cmn.Checksum{s.checksums, nil} {
+		for _, r := range ranges {
+			out, err := cat(t, checksums, r[0], r[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, s.data[r[0]:r[1]]) {
+				t.Fatalf("range %d-%d differs", r[0], r[1])
+			}
+		}
+	}
+
+	t.Run("Corrupt", func(t *testing.T) {
+		s.corrupt = true
+		defer func() { s.corrupt = false }()
+		// the peer's own checksum matches, the one proven by the id
+		// doesn't, and nothing is written
+		out, err := cat(t, s.checksums, 100, 200)
+		if err == nil {
+			t.Fatal("expected the corrupt range to be refused")
+		}
+		if len(out) != 0 {
+			t.Fatalf("%d bytes of a corrupt range were written", len(out))
+		}
+	})
+}
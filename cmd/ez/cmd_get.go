@@ -1,41 +1,102 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/aburdulescu/ez/ezt"
 )
 
+// MAX_FILES is the default number of files downloaded at the same time when
+// more ids are given.
+const MAX_FILES = 4
+
 var fQuiet bool = false
 
 func onGet(args []string) error {
-	if len(args) < 1 {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	fs.BoolVar(&fQuiet, "q", false, "don't show the progress bar")
+	var cfg DownloaderConfig
+	fs.IntVar(&cfg.MaxInflight, "inflight", MAX_INFLIGHT, "max number of chunks downloaded at the same time")
+	fs.IntVar(&cfg.MaxPeerInflight, "peer-inflight", MAX_PEER_INFLIGHT, "max number of chunks downloaded at the same time from one peer")
+	fs.StringVar(&cfg.Output, "o", "", "path of the downloaded file, - for stdout (default: name of the shared file)")
+	fs.StringVar(&cfg.Dir, "C", "", "directory where the file is downloaded")
+	fs.BoolVar(&cfg.Force, "force", false, "overwrite the file if it already exists")
+	maxFiles := fs.Int("j", MAX_FILES, "max number of files downloaded at the same time")
+	fs.DurationVar(&fTimeout, "timeout", OP_TIMEOUT, "max time to wait for each answer of a peer, 0 to wait forever")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
 		return fmt.Errorf("id wasn't provided")
 	}
-	var id string
-	if len(args) > 1 {
-		switch args[0] {
-		case "-q":
-			fQuiet = true
-		default:
-			return fmt.Errorf("unknown flag %s", args[0])
-		}
-		id = args[1]
-	} else {
-		id = args[0]
+	if cfg.MaxInflight < 1 || cfg.MaxPeerInflight < 1 || *maxFiles < 1 {
+		return fmt.Errorf("inflight limits must be greater than 0")
+	}
+	if fTimeout < 0 {
+		return fmt.Errorf("timeout can't be negative")
+	}
+	ids := fs.Args()
+	if len(ids) > 1 && cfg.Output != "" {
+		return fmt.Errorf("-o can't be used with more than one id")
 	}
 	trackerURL, err := getTrackerURL()
 	if err != nil {
 		return err
 	}
 	trackerClient := ezt.NewClient(trackerURL)
-	rsp, err := trackerClient.Get(ezt.GetRequest{id})
+	if len(ids) == 1 {
+		return getFile(trackerClient, ids[0], cfg)
+	}
+
+	// the files share the connections to the peers, and the progress
+	// bars would overwrite each other
+	session := NewSession()
+	defer session.Close()
+	cfg.Dial = session.Dial
+	if *maxFiles > 1 {
+		fQuiet = true
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	sem := make(chan struct{}, *maxFiles)
+	for _, id := range ids {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := getFile(trackerClient, id, cfg); err != nil {
+				mu.Lock()
+				failed = append(failed, id)
+				mu.Unlock()
+			}
+			<-sem
+		}(id)
+	}
+	wg.Wait()
+	if len(failed) != 0 {
+		return fmt.Errorf("%d of %d downloads failed: %v", len(failed), len(ids), failed)
+	}
+	return nil
+}
+
+func getFile(trackerClient ezt.Client, id string, cfg DownloaderConfig) error {
+	rsp, err := trackerClient.Get(ezt.GetRequest{Id: id})
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	var d Downloader
+	d := NewDownloader(cfg)
+	manifest, err := trackerClient.GetManifest(ezt.GetManifestRequest{Id: id})
+	if err == nil {
+		err = d.UseManifest(id, manifest)
+	}
+	if err != nil {
+		log.Println("manifest:", err)
+	}
 	if err := d.Run(id, rsp.IFile, rsp.Peers); err != nil {
 		log.Println(err)
 		return err
@@ -1,13 +1,60 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
 type ConnPoolDialFunc func(addr string) (*SeederClient, error)
 
+// MAX_BUSY_RETRIES is how many more times a seeder which turned down a
+// connection with BUSY is dialed, waiting longer before each attempt.
+const MAX_BUSY_RETRIES = 4
+
+// dialBusy calls dialFunc, dialing again while the seeder is busy.
+func dialBusy(dialFunc ConnPoolDialFunc, addr string) (*SeederClient, error) {
+	for attempt := 1; ; attempt++ {
+		c, err := dialFunc(addr)
+		if err == nil || !errors.Is(err, ErrBusy) || attempt > MAX_BUSY_RETRIES {
+			return c, err
+		}
+		time.Sleep(retryDelay(attempt))
+	}
+}
+
+// LegacyPeers remembers the peers which didn't answer HELLO, so that only the
+// first connection to each of them waits HELLO_TIMEOUT and the next ones
+// speak the legacy protocol right away.
+type LegacyPeers struct {
+	mu    sync.Mutex
+	addrs map[string]bool
+}
+
+func NewLegacyPeers() *LegacyPeers {
+	return &LegacyPeers{addrs: make(map[string]bool)}
+}
+
+// Dial connects to addr like DialSeederClient, it can be used as a
+// ConnPoolDialFunc.
+func (l *LegacyPeers) Dial(addr string) (*SeederClient, error) {
+	l.mu.Lock()
+	legacy := l.addrs[addr]
+	l.mu.Unlock()
+	c, err := dialSeederClient(addr, legacy)
+	if err != nil {
+		return nil, err
+	}
+	if !legacy && c.Legacy() {
+		l.mu.Lock()
+		l.addrs[addr] = true
+		l.mu.Unlock()
+	}
+	return c, nil
+}
+
 type ConnPool struct {
 	mu   sync.RWMutex
 	data map[string][]*SeederClient
@@ -19,7 +66,7 @@ func NewConnPool(peers []string, dialFunc ConnPoolDialFunc) (*ConnPool, []string
 	var goodPeers []string
 	data := make(map[string][]*SeederClient)
 	for _, peer := range peers {
-		c, err := dialFunc(peer)
+		c, err := dialBusy(dialFunc, peer)
 		if err != nil {
 			log.Println(err)
 			continue
@@ -37,12 +84,21 @@ func NewConnPool(peers []string, dialFunc ConnPoolDialFunc) (*ConnPool, []string
 	return pool, goodPeers, nil
 }
 
+// Get returns a connection to addr, dialing a new one if needed. A
+// multiplexed connection stays in the pool and is shared by all the callers,
+// any other connection is owned by the caller until it puts it back.
 func (p *ConnPool) Get(id string, addr string) (*SeederClient, error) {
 	p.mu.Lock()
-	clients, ok := p.data[addr]
-	if ok && len(clients) != 0 {
-		client := clients[0]
+	clients := p.data[addr]
+	for len(clients) != 0 && clients[0].Muxed() && clients[0].Err() != nil {
+		clients[0].Close()
 		clients = clients[1:]
+	}
+	if len(clients) != 0 {
+		client := clients[0]
+		if !client.Muxed() {
+			clients = clients[1:]
+		}
 		if len(clients) == 0 {
 			delete(p.data, addr)
 		} else {
@@ -51,8 +107,9 @@ func (p *ConnPool) Get(id string, addr string) (*SeederClient, error) {
 		p.mu.Unlock()
 		return client, nil
 	} else {
+		delete(p.data, addr)
 		p.mu.Unlock()
-		client, err := p.dialFunc(addr)
+		client, err := dialBusy(p.dialFunc, addr)
 		if err != nil {
 			log.Println(err)
 			return nil, err
@@ -61,14 +118,27 @@ func (p *ConnPool) Get(id string, addr string) (*SeederClient, error) {
 			client.Close()
 			return nil, err
 		}
+		if client.Muxed() {
+			p.Put(addr, client)
+		}
 		return client, nil
 	}
 }
 
 func (p *ConnPool) Put(addr string, client *SeederClient) {
 	p.mu.Lock()
+	defer p.mu.Unlock()
+	if client.Muxed() {
+		if client.Err() != nil {
+			return
+		}
+		for _, c := range p.data[addr] {
+			if c == client {
+				return
+			}
+		}
+	}
 	p.data[addr] = append(p.data[addr], client)
-	p.mu.Unlock()
 }
 
 func (p *ConnPool) Len() int {
@@ -78,20 +148,46 @@ func (p *ConnPool) Len() int {
 	return l
 }
 
+// Connect sends CONNECT on every pooled connection, dropping the ones which
+// fail. It returns an error only if no connection is left.
 func (p *ConnPool) Connect(id string) error {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	for _, clients := range p.data {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var lastErr error
+	for addr, clients := range p.data {
+		var good []*SeederClient
 		for _, client := range clients {
 			if err := client.Connect(id); err != nil {
-				// TODO: remove conn if connect fails
-				return err
+				log.Println(err)
+				client.Close()
+				lastErr = err
+				continue
 			}
+			good = append(good, client)
+		}
+		if len(good) == 0 {
+			delete(p.data, addr)
+		} else {
+			p.data[addr] = good
 		}
 	}
+	if len(p.data) == 0 {
+		return fmt.Errorf("could not connect to any peer: %v", lastErr)
+	}
 	return nil
 }
 
+// Peers returns the addresses which have connections in the pool.
+func (p *ConnPool) Peers() []string {
+	p.mu.RLock()
+	peers := make([]string, 0, len(p.data))
+	for addr := range p.data {
+		peers = append(peers, addr)
+	}
+	p.mu.RUnlock()
+	return peers
+}
+
 func (p *ConnPool) Disconnect() {
 	p.mu.RLock()
 	for _, clients := range p.data {
@@ -2,9 +2,13 @@ package main
 
 import (
 	"log"
+	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/aburdulescu/ez/swp"
 )
 
 type TestSeederClientDialer struct {
@@ -18,7 +22,7 @@ func TestConnPool(t *testing.T) {
 	dialFunc := func(addr string) (*SeederClient, error) {
 		return &SeederClient{}, nil
 	}
-	pool, err := NewConnPool(peers, dialFunc)
+	pool, _, err := NewConnPool(peers, dialFunc)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -42,7 +46,7 @@ func TestConnPool(t *testing.T) {
 
 func testConnPoolGet(i int, wg *sync.WaitGroup, pool *ConnPool, peer string) {
 	defer wg.Done()
-	client, err := pool.Get(peer)
+	client, err := pool.Get("dummy", peer)
 	if err != nil {
 		log.Println(err)
 		return
@@ -53,3 +57,88 @@ func testConnPoolGet(i int, wg *sync.WaitGroup, pool *ConnPool, peer string) {
 		return
 	}
 }
+
+// TestLegacyPeers checks that a seeder which doesn't answer HELLO makes only
+// the first connection wait for it.
+func TestLegacyPeers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var hellos int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// like a seeder older than HELLO, read everything and
+				// answer nothing
+				wire := swp.NewConn(conn)
+				for {
+					msg, cleanup, err := wire.Recv()
+					if err != nil {
+						return
+					}
+					if msg.Type() == swp.HELLO {
+						atomic.AddInt32(&hellos, 1)
+					}
+					cleanup()
+				}
+			}()
+		}
+	}()
+
+	legacy := NewLegacyPeers()
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		c, err := legacy.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Legacy() {
+			t.Fatal("seeder was not detected as legacy")
+		}
+		c.Close()
+		if i > 0 && time.Since(start) >= HELLO_TIMEOUT {
+			t.Fatalf("connection %d waited for HELLO again", i)
+		}
+	}
+	if n := atomic.LoadInt32(&hellos); n != 1 {
+		t.Fatalf("expected 1 HELLO, seeder got %d", n)
+	}
+}
+
+// TestConnPoolBusy checks that a seeder which is busy at first is dialed
+// again.
+func TestConnPoolBusy(t *testing.T) {
+	busy := 2
+	dials := 0
+	dialFunc := func(addr string) (*SeederClient, error) {
+		dials++
+		if dials <= busy {
+			return nil, SeederError{Code: swp.ERR_BUSY}
+		}
+		return &SeederClient{}, nil
+	}
+	pool, peers, err := NewConnPool([]string{"1.1.1.1:111"}, dialFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Release()
+	if len(peers) != 1 || dials != busy+1 {
+		t.Fatalf("expected the peer after %d dials, got %v after %d", busy+1, peers, dials)
+	}
+
+	dials = 0
+	busy = MAX_BUSY_RETRIES + 1
+	if _, _, err := NewConnPool([]string{"1.1.1.1:111"}, dialFunc); err == nil {
+		t.Fatal("expected a seeder which stays busy to be skipped")
+	}
+	if dials != MAX_BUSY_RETRIES+1 {
+		t.Fatalf("expected %d dials, got %d", MAX_BUSY_RETRIES+1, dials)
+	}
+}
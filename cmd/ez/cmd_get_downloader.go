@@ -1,150 +1,553 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/aburdulescu/ez/cmn"
 	"github.com/aburdulescu/ez/ezt"
 	pb "github.com/cheggaaa/pb/v3"
 )
 
-const MAX_CHUNKS uint64 = 8
+// Default limits for the number of chunks downloaded at the same time,
+// overall and from a single peer.
+const (
+	MAX_INFLIGHT      = 8
+	MAX_PEER_INFLIGHT = 4
+)
+
+// MAX_PEER_ATTEMPTS is how many times a chunk is requested from the same
+// peer before that peer is considered exhausted for it.
+const MAX_PEER_ATTEMPTS = 2
+
+const (
+	RETRY_BASE_DELAY = 100 * time.Millisecond
+	RETRY_MAX_DELAY  = 2 * time.Second
+)
+
+const (
+	partSuffix    = ".part"
+	journalSuffix = ".part.state"
+)
+
+type DownloaderConfig struct {
+	MaxInflight     int
+	MaxPeerInflight int
+
+	// Output is the path of the downloaded file, the name of the shared
+	// file if empty, or "-" for stdout. If Dir is set, a relative Output
+	// is placed inside it.
+	Output string
+	Dir    string
+	// Force allows overwriting an existing file.
+	Force bool
+
+	// Dial connects to a peer, LegacyPeers.Dial if nil.
+	Dial ConnPoolDialFunc
+}
 
 type Downloader struct {
 	id       string
 	f        *os.File
+	mu       sync.Mutex
+	journal  *Journal
 	connPool *ConnPool
 	peers    []string
+	sched    *Scheduler
+	stats    *PeerStats
 	pb       *pb.ProgressBar
+
+	// checksums of the chunks, matching the id of the file
+	checksums []cmn.Checksum
+	// size of the file according to the manifest, if one is used
+	manifestSize int64
+
+	// set when streaming to stdout
+	out    chan streamChunk
+	window uint64
+
+	cfg DownloaderConfig
+}
+
+// FatalError is returned when a download can't be resumed later, in which
+// case the partial output is removed.
+type FatalError struct {
+	Err error
+}
+
+func (e FatalError) Error() string {
+	return e.Err.Error()
 }
 
-type Chunk struct {
-	err   error
-	index uint64
-	buf   *bytes.Buffer
+func (e FatalError) Unwrap() error {
+	return e.Err
+}
+
+func NewDownloader(cfg DownloaderConfig) *Downloader {
+	return &Downloader{cfg: cfg}
+}
+
+// UseManifest takes the chunk checksums from a manifest served by the
+// tracker, so they don't have to be requested from the peers.
+func (d *Downloader) UseManifest(id string, m ezt.Manifest) error {
+	if err := m.Verify(id); err != nil {
+		return err
+	}
+	if m.ChunkSize != cmn.ChunkSize {
+		return fmt.Errorf("unsupported chunk size %d", m.ChunkSize)
+	}
+	d.checksums = m.Checksums
+	d.manifestSize = m.Size
+	return nil
 }
 
 func (d *Downloader) Run(id string, ifile ezt.IFile, peers []string) error {
 	d.id = id
+	if d.checksums != nil {
+		if d.manifestSize != ifile.Size || uint64(len(d.checksums)) != chunkCount(ifile.Size) {
+			return fmt.Errorf("manifest of %s describes %d bytes in %d chunks, but the file has %d bytes", id, d.manifestSize, len(d.checksums), ifile.Size)
+		}
+	}
 
-	connPool, goodPeers, err := NewConnPool(peers, DialSeederClient)
-	if err != nil {
-		return err
+	if d.cfg.Output == "-" {
+		if err := d.connect(peers, ifile.Size); err != nil {
+			return err
+		}
+		defer d.disconnect()
+		return d.stream(os.Stdout, ifile.Size)
 	}
-	if connPool.Len() == 0 {
-		return fmt.Errorf("no peers available")
+
+	dst := d.cfg.Output
+	if dst == "" {
+		dst = filepath.Base(ifile.Name)
 	}
-	d.connPool = connPool
-	d.peers = goodPeers
-	defer d.connPool.Release()
-	if err := d.connPool.Connect(id); err != nil {
-		return err
+	if d.cfg.Dir != "" && !filepath.IsAbs(dst) {
+		dst = filepath.Join(d.cfg.Dir, dst)
+	}
+	if !d.cfg.Force {
+		_, err := os.Stat(dst)
+		if err == nil {
+			return fmt.Errorf("%s already exists, use -force to overwrite it", dst)
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
 	}
-	defer d.connPool.Disconnect()
 
-	f, err := os.Create(ifile.Name)
-	if err != nil {
-		log.Println(err)
+	if err := d.connect(peers, ifile.Size); err != nil {
 		return err
 	}
-	if err := f.Truncate(ifile.Size); err != nil {
+	defer d.disconnect()
+
+	partPath := dst + partSuffix
+	if err := d.open(partPath, dst+journalSuffix, ifile.Size); err != nil {
 		log.Println(err)
 		return err
 	}
-	defer f.Close()
-	d.f = f
-	if !fQuiet {
-		d.pb = pb.New64(ifile.Size)
-		d.pb.Set(pb.Bytes, true)
-		d.pb.Set(pb.SIBytesPrefix, true)
-		d.pb.Start()
-		defer d.pb.Finish()
-	}
+	defer d.f.Close()
 
-	nchunks := uint64(ifile.Size / cmn.ChunkSize)
-	if ifile.Size%cmn.ChunkSize != 0 {
-		nchunks++
+	err := d.fetchMissing(ifile.Size)
+	if err == nil {
+		err = d.finalize(partPath, dst, ifile.Size)
 	}
-
-	n := nchunks / MAX_CHUNKS
-	for i := uint64(0); i < n; i++ {
-		start := i * MAX_CHUNKS
-		end := start + MAX_CHUNKS
-		if err := d.dwChunks(start, end); err != nil {
+	var fatal FatalError
+	if errors.As(err, &fatal) {
+		d.f.Close()
+		if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		if err := d.journal.Remove(); err != nil {
 			log.Println(err)
+		}
+	}
+	return err
+}
+
+// open opens the .part file of a previous download of the same file, or
+// creates a new one.
+func (d *Downloader) open(partPath, journalPath string, size int64) error {
+	nchunks := chunkCount(size)
+	journal, err := LoadJournal(journalPath, d.id, size, nchunks)
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	if journal != nil {
+		f, err = os.OpenFile(partPath, os.O_RDWR, 0)
+		if err == nil {
+			if err := journal.Verify(f, d.checksums); err != nil {
+				f.Close()
+				return err
+			}
+		} else if !os.IsNotExist(err) {
 			return err
 		}
 	}
+	if f == nil {
+		journal = NewJournal(journalPath, d.id, size, nchunks)
+		f, err = os.Create(partPath)
+		if err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	d.f = f
+	d.journal = journal
+	return nil
+}
 
-	remainder := nchunks % MAX_CHUNKS
-	if remainder == 0 {
+func (d *Downloader) fetchMissing(size int64) error {
+	missing := d.journal.Missing()
+	if len(missing) == 0 {
 		return nil
 	}
+	if err := d.download(size, missing); err != nil {
+		return err
+	}
+	if missing := d.journal.Missing(); len(missing) != 0 {
+		return fmt.Errorf("%d chunks could not be downloaded, run the command again to resume", len(missing))
+	}
+	return nil
+}
 
-	start := nchunks - remainder
-	end := start + remainder
-
-	if err := d.dwChunks(start, end); err != nil {
+// finalize flushes the .part file to disk and moves it atomically to dst.
+// All its chunks were verified, so the .part file and its journal are kept
+// if that fails, e.g. because dst is a directory, and the next run only
+// finalizes them.
+func (d *Downloader) finalize(partPath, dst string, size int64) error {
+	fi, err := d.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != size {
+		return FatalError{fmt.Errorf("downloaded file has different size than expected: expected %d, got %d", size, fi.Size())}
+	}
+	if err := d.f.Sync(); err != nil {
+		return err
+	}
+	if err := d.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, dst); err != nil {
+		return fmt.Errorf("%w, the download was kept in %s", err, partPath)
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
 		log.Println(err)
+	}
+	if err := d.journal.Remove(); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// syncDir makes a rename inside dir durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
 		return err
 	}
+	defer f.Close()
+	return f.Sync()
+}
 
-	fi, err := f.Stat()
+// connect opens connections to the peers and gets the checksums of the
+// chunks.
+func (d *Downloader) connect(peers []string, size int64) error {
+	dial := d.cfg.Dial
+	if dial == nil {
+		dial = NewLegacyPeers().Dial
+	}
+	connPool, _, err := NewConnPool(peers, dial)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-	if fi.Size() != ifile.Size {
-		return fmt.Errorf("downloaded file has different size than expected: expected %d, got %d", ifile.Size, fi.Size())
+	if connPool.Len() == 0 {
+		return fmt.Errorf("no peers available")
+	}
+	d.connPool = connPool
+	if err := d.connPool.Connect(d.id); err != nil {
+		d.connPool.Release()
+		return err
+	}
+	d.peers = d.connPool.Peers()
+	if err := d.loadChecksums(chunkCount(size)); err != nil {
+		d.disconnect()
+		return err
 	}
-
 	return nil
 }
 
-func (d Downloader) dwChunks(start, end uint64) error {
-	peerCount := 0
-	result := make(chan Chunk)
-	for index := start; index < end; index++ {
-		peerIndex := peerCount % len(d.peers)
-		peer := d.peers[peerIndex]
+func (d *Downloader) disconnect() {
+	d.connPool.Disconnect()
+	d.connPool.Release()
+}
+
+// loadChecksums gets the list of chunk checksums from the peers, unless it
+// came with the manifest, and keeps the first one which hashes to the id of
+// the file. Since the id is computed from it, the list can be trusted and
+// every chunk is verified against it, not against what the peer sending the
+// chunk claims. Peers which send a different list are not used, the ones
+// which can't send any, like legacy seeders, are.
+func (d *Downloader) loadChecksums(nchunks uint64) error {
+	if d.checksums != nil {
+		return nil
+	}
+	var good []string
+	legacy := 0
+	for _, peer := range d.peers {
+		if d.checksums != nil {
+			good = append(good, peer)
+			continue
+		}
 		client, err := d.connPool.Get(d.id, peer)
 		if err != nil {
-			// TODO: don't skip it, maybe try with other peer?
+			log.Println(err)
+			continue
+		}
+		checksums, err := client.Getchecksums(nchunks)
+		if errors.Is(err, ErrNoChecksums) {
+			d.connPool.Put(peer, client)
+			good = append(good, peer)
+			legacy++
+			continue
+		}
+		if err != nil {
+			log.Printf("checksums from %s: %v", peer, err)
+			if client.Broken(err) {
+				client.Close()
+			} else {
+				d.connPool.Put(peer, client)
+			}
 			continue
 		}
-		go d.fetch(peer, client, index, result)
-		peerCount++
+		d.connPool.Put(peer, client)
+		if cmn.NewID(checksums) != d.id {
+			log.Printf("checksums from %s don't match id %s", peer, d.id)
+			continue
+		}
+		d.checksums = checksums
+		good = append(good, peer)
+	}
+	if d.checksums == nil {
+		if legacy != 0 {
+			return FatalError{fmt.Errorf("no peer could prove that it has the content of %s: the tracker has no manifest of it and %d peers are too old to send checksums", d.id, legacy)}
+		}
+		return FatalError{fmt.Errorf("no peer could prove that it has the content of %s", d.id)}
+	}
+	d.peers = good
+	return nil
+}
+
+func (d *Downloader) download(size int64, chunks []uint64) error {
+	peers := d.peers
+
+	if !fQuiet {
+		d.pb = pb.New64(size)
+		d.pb.Set(pb.Bytes, true)
+		d.pb.Set(pb.SIBytesPrefix, true)
+		if d.journal != nil {
+			d.pb.SetCurrent(d.journal.DoneBytes())
+		}
+		d.pb.Start()
+	}
+
+	d.stats = NewPeerStats(peers)
+	d.sched = NewScheduler(chunks, peers, d.stats, d.cfg.MaxInflight, d.cfg.MaxPeerInflight)
+	if d.window != 0 {
+		d.sched.SetLimit(d.window)
 	}
-	for i := uint64(0); i < (end - start); i++ {
-		chunk := <-result
-		if chunk.err != nil {
-			log.Println(chunk.err)
-			// TODO: retry chunk download
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		for i := 0; i < d.cfg.MaxPeerInflight; i++ {
+			wg.Add(1)
+			go d.worker(peer, &wg)
+		}
+	}
+	wg.Wait()
+
+	if !fQuiet {
+		d.pb.Finish()
+		d.stats.Print(os.Stderr)
+	}
+
+	return d.sched.Err()
+}
+
+// worker downloads chunks from peer, over its own connection, until the
+// scheduler has nothing left for it.
+func (d *Downloader) worker(peer string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var client *SeederClient
+	for {
+		task, ok := d.sched.Next(peer)
+		if !ok {
+			break
+		}
+		if client == nil {
+			c, err := d.connPool.Get(d.id, peer)
+			if err != nil {
+				log.Println(err)
+				if d.stats.Failure(peer) {
+					log.Printf("dropping peer %s", peer)
+					d.sched.Drop(peer)
+				}
+				d.sched.Retry(task, peer)
+				continue
+			}
+			client = c
+		}
+		if delay := retryDelay(task.attempts); delay != 0 {
+			time.Sleep(delay)
+		}
+		// the first fetcher of a chunk streams it to the file, endgame
+		// copies are kept in memory until one of them wins; when streaming
+		// to stdout every chunk is kept in memory until its turn comes
+		var w io.WriterAt
+		var mem ChunkBuffer
+		owner := d.out == nil && task.claimWriter()
+		if owner {
+			w = chunkWriter{f: d.f, task: task}
+		} else {
+			mem = AllocChunk()
+			w = mem
+		}
+		start := time.Now()
+		n, err := client.Getchunk(task.ctx, task.index, d.checksums[task.index], w)
+		if err != nil {
+			if owner {
+				task.releaseWriter()
+			} else {
+				ReleaseChunk(mem)
+			}
+		}
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			log.Println(err)
+			d.sched.Fail(FatalError{err})
+			break
+		}
+		if err != nil && task.ctx.Err() != nil {
+			// another copy of the chunk won the race
+			if client.Broken(err) {
+				client.Close()
+				client = nil
+			}
+			d.sched.Abandon(task, peer)
 			continue
 		}
-		off := int64(chunk.index * cmn.ChunkSize)
-		n, err := d.f.WriteAt(chunk.buf.Bytes(), off)
 		if err != nil {
-			log.Println(err, n)
-			return err
+			log.Printf("chunk %d from %s: %v", task.index, peer, err)
+			if client.Broken(err) {
+				client.Close()
+				client = nil
+			}
+			// the peer doesn't have the file anymore or has a different one
+			if errors.Is(err, ErrUnknownId) || errors.Is(err, ErrOutOfRange) || errors.Is(err, ErrNotConnected) {
+				log.Printf("dropping peer %s", peer)
+				d.sched.Drop(peer)
+				d.sched.Retry(task, peer)
+				continue
+			}
+			if d.stats.Failure(peer) {
+				log.Printf("dropping peer %s", peer)
+				d.sched.Drop(peer)
+			}
+			d.sched.Retry(task, peer)
+			continue
+		}
+		d.stats.Success(peer, n, time.Since(start), client.Latency())
+		if !d.sched.Complete(task, peer) {
+			if !owner {
+				ReleaseChunk(mem)
+			}
+			continue
 		}
-		ReleaseChunk(chunk.buf)
-		if !fQuiet {
-			d.pb.Add(n)
+		if d.out != nil {
+			d.out <- streamChunk{index: task.index, buf: mem, n: n}
+		} else if !owner {
+			err = d.writeCopy(task, mem[:n])
+			ReleaseChunk(mem)
+			if err != nil {
+				log.Println(err)
+				d.sched.Fail(FatalError{err})
+				break
+			}
+		}
+		if err := d.markDone(task.index, n, d.checksums[task.index]); err != nil {
+			log.Println(err)
+			d.sched.Fail(FatalError{err})
+			break
 		}
 	}
+	if client != nil {
+		d.connPool.Put(peer, client)
+	}
+}
+
+// writeCopy writes a chunk which was fetched in memory to the file, after
+// any write still in progress from the streaming fetcher of the chunk.
+func (d *Downloader) writeCopy(task *chunkTask, b []byte) error {
+	task.wmu.Lock()
+	defer task.wmu.Unlock()
+	_, err := d.f.WriteAt(b, int64(task.index*cmn.ChunkSize))
+	return err
+}
+
+func (d *Downloader) markDone(index uint64, n int64, checksum cmn.Checksum) error {
+	if d.journal != nil {
+		d.mu.Lock()
+		err := d.journal.MarkDone(index, checksum)
+		d.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if !fQuiet {
+		d.pb.Add64(n)
+	}
 	return nil
 }
 
-func (d Downloader) fetch(peer string, client *SeederClient, index uint64, result chan Chunk) {
-	buf, err := client.Getchunk(index)
-	if err != nil {
-		result <- Chunk{err, index, nil}
-		return
+// chunkWriter writes the pieces of a chunk to their place in the file. It
+// stops writing once another copy of the chunk completed.
+type chunkWriter struct {
+	f    *os.File
+	task *chunkTask
+}
+
+func (w chunkWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.task.wmu.Lock()
+	defer w.task.wmu.Unlock()
+	if err := w.task.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.f.WriteAt(p, int64(w.task.index*cmn.ChunkSize)+off)
+}
+
+func chunkCount(size int64) uint64 {
+	n := uint64(size / cmn.ChunkSize)
+	if size%cmn.ChunkSize != 0 {
+		n++
+	}
+	return n
+}
+
+func retryDelay(attempt int) time.Duration {
+	if attempt == 0 {
+		return 0
+	}
+	delay := RETRY_BASE_DELAY << (attempt - 1)
+	if delay > RETRY_MAX_DELAY {
+		delay = RETRY_MAX_DELAY
 	}
-	d.connPool.Put(peer, client)
-	result <- Chunk{nil, index, buf}
+	return delay
 }
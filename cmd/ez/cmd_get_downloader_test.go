@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aburdulescu/ez/cmn"
+	"github.com/aburdulescu/ez/ezt"
+	"github.com/aburdulescu/ez/swp"
+)
+
+// fakeSeeder serves a file from memory over net.Pipe connections. Every
+// request is answered in its own goroutine, so the chunks of a multiplexed
+// connection can arrive out of order.
+type fakeSeeder struct {
+	data      []byte
+	checksums []cmn.Checksum
+	id        string
+	// caps are the capabilities the seeder supports, if legacy is false
+	caps   swp.Caps
+	legacy bool
+	// delay returns how long to wait before answering GETCHUNK for a chunk
+	delay func(index uint64) time.Duration
+	// sent is called once a chunk was sent
+	sent func(index uint64)
+	// lie makes the checksums sent with GETCHECKSUMS differ from the file
+	lie bool
+	// hangup makes the seeder close the connection on GETCHUNK
+	hangup bool
+	// corrupt makes the ranges differ from the file, with a matching
+	// checksum
+	corrupt bool
+
+	mu    sync.Mutex
+	dials int
+	// handles are the ones given by OPEN, which CLOSE takes back
+	handles    map[swp.Handle]bool
+	nextHandle swp.Handle
+}
+
+func (s *fakeSeeder) Dials() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+// Handles returns how many files are open with OPEN.
+func (s *fakeSeeder) Handles() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.handles)
+}
+
+func newFakeSeeder(t testing.TB, size int) *fakeSeeder {
+	data := make([]byte, size)
+	rand.Read(data)
+	s := &fakeSeeder{data: data, caps: swp.CapChecksums | swp.CapRequestIds}
+	for off := 0; off < size; off += cmn.ChunkSize {
+		end := off + cmn.ChunkSize
+		if end > size {
+			end = size
+		}
+		s.checksums = append(s.checksums, cmn.NewChecksum(data[off:end]))
+	}
+	s.id = cmn.NewID(s.checksums)
+	return s
+}
+
+func (s *fakeSeeder) ifile(name string) ezt.IFile {
+	return ezt.IFile{Name: name, Size: int64(len(s.data))}
+}
+
+// Dial is a ConnPoolDialFunc which connects to the seeder.
+func (s *fakeSeeder) Dial(addr string) (*SeederClient, error) {
+	s.mu.Lock()
+	s.dials++
+	s.mu.Unlock()
+	cconn, sconn := net.Pipe()
+	go s.serve(sconn)
+	c := &SeederClient{conn: cconn, wire: swp.NewConn(cconn), timeout: fTimeout}
+	if err := c.hello(); err != nil {
+		cconn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *fakeSeeder) serve(conn net.Conn) {
+	defer conn.Close()
+	var wire *swp.Conn
+	if s.legacy {
+		// a seeder older than HELLO doesn't answer it; the client gives
+		// up waiting and then speaks the legacy protocol
+		wire = swp.NewConn(conn)
+		_, cleanup, err := wire.Recv()
+		if err != nil {
+			return
+		}
+		cleanup()
+	} else {
+		wire = acceptHello(conn, s.caps)
+	}
+	if wire == nil {
+		return
+	}
+	var wmu sync.Mutex
+	send := func(tag uint32, msg swp.Msg) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		return wire.SendTagged(tag, msg)
+	}
+	muxed := s.caps.Has(swp.CapRequestIds) && !s.legacy
+	for {
+		tag, msg, cleanup, err := wire.RecvTagged()
+		if err != nil {
+			return
+		}
+		cleanup()
+		if s.hangup && msg.Type() == swp.GETCHUNK {
+			return
+		}
+		if muxed {
+			go s.answer(tag, msg, send)
+		} else {
+			s.answer(tag, msg, send)
+		}
+	}
+}
+
+func (s *fakeSeeder) answer(tag uint32, msg swp.Msg, send func(uint32, swp.Msg) error) {
+	switch msg.Type() {
+	case swp.CONNECT, swp.DISCONNECT, swp.CANCEL:
+		send(tag, swp.Ack{})
+	case swp.OPEN:
+		if msg.(swp.Open).Id != s.id {
+			send(tag, swp.Error{Code: swp.ERR_UNKNOWN_ID})
+			return
+		}
+		s.mu.Lock()
+		if s.handles == nil {
+			s.handles = make(map[swp.Handle]bool)
+		}
+		s.nextHandle++
+		handle := s.nextHandle
+		s.handles[handle] = true
+		s.mu.Unlock()
+		send(tag, swp.Opened{Handle: handle})
+	case swp.CLOSE:
+		handle := msg.(swp.Close).Handle
+		s.mu.Lock()
+		ok := s.handles[handle]
+		delete(s.handles, handle)
+		s.mu.Unlock()
+		if !ok {
+			send(tag, swp.Error{Code: swp.ERR_NOT_CONNECTED})
+			return
+		}
+		send(tag, swp.Ack{})
+	case swp.GETCHECKSUMS:
+		start := msg.(swp.Getchecksums).Start
+		rsp := swp.Checksums{Total: uint64(len(s.checksums))}
+		for i := start; i < uint64(len(s.checksums)) && len(rsp.Checksums) < swp.MaxChecksums; i++ {
+			rsp.Checksums = append(rsp.Checksums, uint64(s.checksums[i]))
+		}
+		if s.lie && len(rsp.Checksums) != 0 {
+			rsp.Checksums[0]++
+		}
+		send(tag, rsp)
+	case swp.GETCHUNK:
+		index := msg.(swp.Getchunk).Index
+		if index >= uint64(len(s.checksums)) {
+			send(tag, swp.Error{Code: swp.ERR_OUT_OF_RANGE})
+			return
+		}
+		if s.delay != nil {
+			time.Sleep(s.delay(index))
+		}
+		off := index * cmn.ChunkSize
+		end := off + cmn.ChunkSize
+		if end > uint64(len(s.data)) {
+			end = uint64(len(s.data))
+		}
+		s.sendPieces(tag, s.data[off:end], s.checksums[index], send)
+		if s.sent != nil {
+			s.sent(index)
+		}
+	case swp.GETRANGE:
+		req := msg.(swp.Getrange)
+		if req.Offset > uint64(len(s.data)) {
+			send(tag, swp.Error{Code: swp.ERR_OUT_OF_RANGE})
+			return
+		}
+		end := req.Offset + req.Length
+		if end > uint64(len(s.data)) {
+			end = uint64(len(s.data))
+		}
+		data := append([]byte(nil), s.data[req.Offset:end]...)
+		if s.corrupt && len(data) != 0 {
+			data[len(data)/2] ^= 0xff
+		}
+		s.sendPieces(tag, data, cmn.NewChecksum(data), send)
+	default:
+		send(tag, swp.Error{Code: swp.ERR_BAD_REQUEST})
+	}
+}
+
+func (s *fakeSeeder) sendPieces(tag uint32, data []byte, checksum cmn.Checksum, send func(uint32, swp.Msg) error) {
+	npieces := (len(data) + cmn.PieceSize - 1) / cmn.PieceSize
+	if err := send(tag, swp.Chunkinfo{NPieces: uint64(npieces), Checksum: uint64(checksum)}); err != nil {
+		return
+	}
+	for off := 0; off < len(data); off += cmn.PieceSize {
+		end := off + cmn.PieceSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := send(tag, swp.Piece{Piece: data[off:end]}); err != nil {
+			return
+		}
+	}
+}
+
+func testDownloaderConfig(s *fakeSeeder) DownloaderConfig {
+	return DownloaderConfig{
+		MaxInflight:     MAX_INFLIGHT,
+		MaxPeerInflight: MAX_PEER_INFLIGHT,
+		Dial:            s.Dial,
+	}
+}
+
+func checkFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("%s differs from the shared file", path)
+	}
+	for _, suffix := range []string{partSuffix, journalSuffix} {
+		if _, err := os.Stat(path + suffix); !os.IsNotExist(err) {
+			t.Fatalf("%s%s was not removed", path, suffix)
+		}
+	}
+}
+
+func TestDownloaderOutput(t *testing.T) {
+	fQuiet = true
+	s := newFakeSeeder(t, cmn.ChunkSize+1000)
+	peers := []string{"peer"}
+
+	t.Run("Dir", func(t *testing.T) {
+		dir := t.TempDir()
+		cfg := testDownloaderConfig(s)
+		cfg.Dir = dir
+		if err := NewDownloader(cfg).Run(s.id, s.ifile("shared.bin"), peers); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, filepath.Join(dir, "shared.bin"), s.data)
+	})
+
+	t.Run("Output", func(t *testing.T) {
+		dir := t.TempDir()
+		cfg := testDownloaderConfig(s)
+		cfg.Dir = dir
+		cfg.Output = "renamed.bin"
+		if err := NewDownloader(cfg).Run(s.id, s.ifile("shared.bin"), peers); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, filepath.Join(dir, "renamed.bin"), s.data)
+
+		// an absolute output is not placed in the directory
+		abs := filepath.Join(t.TempDir(), "abs.bin")
+		cfg.Output = abs
+		if err := NewDownloader(cfg).Run(s.id, s.ifile("shared.bin"), peers); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, abs, s.data)
+	})
+
+	t.Run("Force", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "existing.bin")
+		if err := os.WriteFile(dst, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := testDownloaderConfig(s)
+		cfg.Output = dst
+		err := NewDownloader(cfg).Run(s.id, s.ifile("shared.bin"), peers)
+		if err == nil || !strings.Contains(err.Error(), "-force") {
+			t.Fatal("expected the existing file to be kept, got", err)
+		}
+		if b, _ := os.ReadFile(dst); string(b) != "old" {
+			t.Fatal("existing file was changed")
+		}
+		cfg.Force = true
+		if err := NewDownloader(cfg).Run(s.id, s.ifile("shared.bin"), peers); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, dst, s.data)
+	})
+
+	t.Run("FinalizeFails", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "dir")
+		if err := os.MkdirAll(filepath.Join(dst, "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		cfg := testDownloaderConfig(s)
+		cfg.Output = dst
+		cfg.Force = true
+		if err := NewDownloader(cfg).Run(s.id, s.ifile("shared.bin"), peers); err == nil {
+			t.Fatal("expected the rename over a directory to fail")
+		}
+		b, err := os.ReadFile(dst + partSuffix)
+		if err != nil {
+			t.Fatal("verified download was removed:", err)
+		}
+		if !bytes.Equal(b, s.data) {
+			t.Fatal("kept download differs from the shared file")
+		}
+		if _, err := os.Stat(dst + journalSuffix); err != nil {
+			t.Fatal("journal was removed:", err)
+		}
+
+		// once the directory is gone, the next run only finalizes
+		if err := os.RemoveAll(dst); err != nil {
+			t.Fatal(err)
+		}
+		again := &fakeSeeder{data: s.data, checksums: s.checksums, id: s.id, caps: s.caps}
+		again.delay = func(uint64) time.Duration {
+			t.Error("chunk downloaded again")
+			return 0
+		}
+		cfg.Dial = again.Dial
+		if err := NewDownloader(cfg).Run(s.id, s.ifile("shared.bin"), peers); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, dst, s.data)
+	})
+}
+
+func TestDownloaderManifest(t *testing.T) {
+	fQuiet = true
+	s := newFakeSeeder(t, cmn.ChunkSize+1000)
+	// the checksums come only from the manifest
+	s.caps = swp.CapRequestIds
+	m := ezt.NewManifest(int64(len(s.data)), s.checksums)
+	peers := []string{"peer"}
+
+	t.Run("Valid", func(t *testing.T) {
+		dir := t.TempDir()
+		cfg := testDownloaderConfig(s)
+		cfg.Dir = dir
+		d := NewDownloader(cfg)
+		if err := d.UseManifest(s.id, m); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(s.id, s.ifile("shared.bin"), peers); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, filepath.Join(dir, "shared.bin"), s.data)
+	})
+
+	t.Run("SizeMismatch", func(t *testing.T) {
+		for _, size := range []int64{int64(len(s.data)) + cmn.ChunkSize, int64(len(s.data)) - 1} {
+			dir := t.TempDir()
+			cfg := testDownloaderConfig(s)
+			cfg.Dir = dir
+			d := NewDownloader(cfg)
+			if err := d.UseManifest(s.id, m); err != nil {
+				t.Fatal(err)
+			}
+			ifile := ezt.IFile{Name: "shared.bin", Size: size}
+			if err := d.Run(s.id, ifile, peers); err == nil {
+				t.Fatalf("expected a manifest for %d bytes to be rejected for a file of %d bytes", len(s.data), size)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Fatalf("rejected download left %d files behind", len(entries))
+			}
+		}
+	})
+}
+
+func TestDownloaderChecksums(t *testing.T) {
+	fQuiet = true
+	honest := newFakeSeeder(t, cmn.ChunkSize+1000)
+	newSeeder := func(caps swp.Caps, lie bool) *fakeSeeder {
+		return &fakeSeeder{data: honest.data, checksums: honest.checksums, id: honest.id, caps: caps, lie: lie}
+	}
+	seeders := map[string]*fakeSeeder{
+		"honest": honest,
+		"old":    newSeeder(swp.CapRequestIds, false),
+		"liar":   newSeeder(honest.caps, true),
+	}
+	dial := func(addr string) (*SeederClient, error) {
+		return seeders[addr].Dial(addr)
+	}
+	connect := func(t *testing.T, peers ...string) ([]string, error) {
+		d := NewDownloader(DownloaderConfig{MaxInflight: 1, MaxPeerInflight: 1, Dial: dial})
+		d.id = honest.id
+		if err := d.connect(peers, int64(len(honest.data))); err != nil {
+			return nil, err
+		}
+		defer d.disconnect()
+		sort.Strings(d.peers)
+		return d.peers, nil
+	}
+
+	t.Run("Order", func(t *testing.T) {
+		// a peer which can't send checksums is used whether it comes
+		// before or after the one which proves the list
+		for _, peers := range [][]string{{"old", "honest"}, {"honest", "old"}} {
+			got, err := connect(t, peers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 2 {
+				t.Fatalf("peers %v: expected both to be used, got %v", peers, got)
+			}
+		}
+	})
+
+	t.Run("Liar", func(t *testing.T) {
+		if _, err := connect(t, "liar"); err == nil {
+			t.Fatal("expected a peer with checksums which don't match the id to be refused")
+		}
+		// the liar is kept only if the honest peer was asked first, its
+		// chunks fail the check against the proven list anyway
+		got, err := connect(t, "liar", "honest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i := sort.SearchStrings(got, "honest"); i == len(got) || got[i] != "honest" {
+			t.Fatal("expected the honest peer to be used, got", got)
+		}
+	})
+
+	t.Run("OnlyOld", func(t *testing.T) {
+		_, err := connect(t, "old")
+		if err == nil || !strings.Contains(err.Error(), "manifest") {
+			t.Fatal("expected the missing manifest to be reported, got", err)
+		}
+	})
+}
+
+// TestDownloaderDeadPeer checks that a peer which can't be reached anymore is
+// dropped and its chunks are downloaded from the others.
+func TestDownloaderDeadPeer(t *testing.T) {
+	fQuiet = true
+	good := newFakeSeeder(t, 4*cmn.ChunkSize)
+	good.delay = func(uint64) time.Duration { return 50 * time.Millisecond }
+	dead := &fakeSeeder{data: good.data, checksums: good.checksums, id: good.id, caps: good.caps, hangup: true}
+	dial := func(addr string) (*SeederClient, error) {
+		if addr == "good" {
+			return good.Dial(addr)
+		}
+		if dead.Dials() != 0 {
+			return nil, errors.New("connection refused")
+		}
+		return dead.Dial(addr)
+	}
+	cfg := DownloaderConfig{MaxInflight: 4, MaxPeerInflight: 1, Dir: t.TempDir(), Dial: dial}
+	d := NewDownloader(cfg)
+	if err := d.Run(good.id, good.ifile("shared.bin"), []string{"dead", "good"}); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(cfg.Dir, "shared.bin"), good.data)
+	if !d.stats.peers["dead"].Dropped {
+		t.Fatal("dead peer was not dropped")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+
+	"github.com/aburdulescu/ez/cmn"
+)
+
+// Journal records which chunks of a download were written to the .part file,
+// together with the checksum each one was verified against, so that an
+// interrupted download can be resumed.
+type Journal struct {
+	Id        string         `json:"id"`
+	Size      int64          `json:"size"`
+	Done      []byte         `json:"done"`
+	Checksums []cmn.Checksum `json:"checksums"`
+
+	path string
+}
+
+func NewJournal(path, id string, size int64, nchunks uint64) *Journal {
+	return &Journal{
+		Id:        id,
+		Size:      size,
+		Done:      make([]byte, (nchunks+7)/8),
+		Checksums: make([]cmn.Checksum, nchunks),
+		path:      path,
+	}
+}
+
+// LoadJournal reads the journal stored at path. It returns nil without an
+// error if there is no journal or if it belongs to a different download.
+func LoadJournal(path, id string, size int64, nchunks uint64) (*Journal, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var j Journal
+	if err := json.NewDecoder(f).Decode(&j); err != nil {
+		log.Println(err)
+		return nil, nil
+	}
+	if j.Id != id || j.Size != size || uint64(len(j.Checksums)) != nchunks || len(j.Done) != int((nchunks+7)/8) {
+		return nil, nil
+	}
+	j.path = path
+	return &j, nil
+}
+
+func (j *Journal) IsDone(index uint64) bool {
+	return j.Done[index/8]&(1<<(index%8)) != 0
+}
+
+func (j *Journal) MarkDone(index uint64, checksum cmn.Checksum) error {
+	j.Done[index/8] |= 1 << (index % 8)
+	j.Checksums[index] = checksum
+	return j.Save()
+}
+
+func (j *Journal) clear(index uint64) {
+	j.Done[index/8] &^= 1 << (index % 8)
+	j.Checksums[index] = 0
+}
+
+// Missing returns the indexes of the chunks which are not done yet.
+func (j *Journal) Missing() []uint64 {
+	var missing []uint64
+	for i := range j.Checksums {
+		if !j.IsDone(uint64(i)) {
+			missing = append(missing, uint64(i))
+		}
+	}
+	return missing
+}
+
+// DoneBytes returns the number of bytes covered by the completed chunks.
+func (j *Journal) DoneBytes() int64 {
+	var n int64
+	for i := range j.Checksums {
+		if j.IsDone(uint64(i)) {
+			n += chunkLen(j.Size, uint64(i))
+		}
+	}
+	return n
+}
+
+// Verify re-reads every completed chunk from f and clears the ones whose
+// content doesn't match the expected checksum.
+func (j *Journal) Verify(f *os.File, expected []cmn.Checksum) error {
+	for i := range j.Checksums {
+		index := uint64(i)
+		if !j.IsDone(index) {
+			continue
+		}
+		digest := cmn.NewDigest()
+		r := io.NewSectionReader(f, int64(index*cmn.ChunkSize), chunkLen(j.Size, index))
+		if _, err := io.Copy(digest, r); err != nil {
+			return err
+		}
+		if sum := digest.Sum(); sum != j.Checksums[index] || sum != expected[index] {
+			log.Printf("chunk %d is corrupted, will download it again", index)
+			j.clear(index)
+		}
+	}
+	return j.Save()
+}
+
+func (j *Journal) Save() error {
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(j); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+func (j *Journal) Remove() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func chunkLen(size int64, index uint64) int64 {
+	off := int64(index * cmn.ChunkSize)
+	if size-off < cmn.ChunkSize {
+		return size - off
+	}
+	return cmn.ChunkSize
+}
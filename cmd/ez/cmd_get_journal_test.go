@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aburdulescu/ez/cmn"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f"+journalSuffix)
+
+	size := int64(2*cmn.ChunkSize + 10)
+	nchunks := uint64(3)
+
+	data := bytes.Repeat([]byte{42}, int(size))
+	f, err := os.Create(filepath.Join(dir, "f"+partSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	checksums := []cmn.Checksum{
+		cmn.NewChecksum(data[:cmn.ChunkSize]),
+		cmn.NewChecksum(data[cmn.ChunkSize : 2*cmn.ChunkSize]),
+		cmn.NewChecksum(data[2*cmn.ChunkSize:]),
+	}
+
+	j := NewJournal(path, "id0", size, nchunks)
+	if err := j.MarkDone(0, checksums[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.MarkDone(2, checksums[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("OtherDownload", func(t *testing.T) {
+		other, err := LoadJournal(path, "id1", size, nchunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other != nil {
+			t.Fatal("expected no journal for a different id")
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		loaded, err := LoadJournal(path, "id0", size, nchunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded == nil {
+			t.Fatal("journal was not loaded")
+		}
+		missing := loaded.Missing()
+		if len(missing) != 1 || missing[0] != 1 {
+			t.Fatalf("expected [1], got %v", missing)
+		}
+		if n := loaded.DoneBytes(); n != cmn.ChunkSize+10 {
+			t.Fatalf("expected %d, got %d", cmn.ChunkSize+10, n)
+		}
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		if _, err := f.WriteAt([]byte{0}, 2*cmn.ChunkSize); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadJournal(path, "id0", size, nchunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := loaded.Verify(f, checksums); err != nil {
+			t.Fatal(err)
+		}
+		missing := loaded.Missing()
+		if len(missing) != 2 || missing[0] != 1 || missing[1] != 2 {
+			t.Fatalf("expected [1 2], got %v", missing)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aburdulescu/ez/cmn"
+)
+
+// MAX_PEER_FAILURES is the number of consecutive failed chunks after which a
+// peer is dropped from the download.
+const MAX_PEER_FAILURES = 3
+
+// weight given to the newest sample in the rate and latency averages
+const statsAlpha = 0.3
+
+type PeerStat struct {
+	Bytes    int64
+	Chunks   int
+	Failures int
+	Busy     time.Duration
+	Rate     float64 // bytes per second, moving average
+	Latency  time.Duration
+	Dropped  bool
+
+	consecutiveFailures int
+}
+
+// AvgRate returns the average transfer rate in bytes per second.
+func (s PeerStat) AvgRate() float64 {
+	if s.Busy == 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Busy.Seconds()
+}
+
+// PeerStats measures how each peer performs during a download.
+type PeerStats struct {
+	mu    sync.Mutex
+	peers map[string]*PeerStat
+}
+
+func NewPeerStats(peers []string) *PeerStats {
+	s := &PeerStats{peers: make(map[string]*PeerStat)}
+	for _, peer := range peers {
+		s.peers[peer] = &PeerStat{}
+	}
+	return s
+}
+
+func (s *PeerStats) Success(peer string, n int64, elapsed, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.peers[peer]
+	st.Bytes += n
+	st.Chunks++
+	st.Busy += elapsed
+	st.consecutiveFailures = 0
+	rate := float64(n) / elapsed.Seconds()
+	if st.Rate == 0 {
+		st.Rate = rate
+		st.Latency = latency
+	} else {
+		st.Rate = statsAlpha*rate + (1-statsAlpha)*st.Rate
+		st.Latency = time.Duration(statsAlpha*float64(latency) + (1-statsAlpha)*float64(st.Latency))
+	}
+}
+
+// Failure records a failed chunk or connection and returns true if the peer
+// should be dropped.
+func (s *PeerStats) Failure(peer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.peers[peer]
+	st.Failures++
+	st.consecutiveFailures++
+	if st.consecutiveFailures >= MAX_PEER_FAILURES {
+		st.Dropped = true
+	}
+	return st.Dropped
+}
+
+// Speed returns the rate of peer relative to the fastest peer, between 0
+// and 1. Peers which were not measured yet are considered as fast as the
+// fastest one.
+func (s *PeerStats) Speed(peer string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.peers[peer]
+	if st.Rate == 0 {
+		return 1
+	}
+	best := 0.0
+	for _, p := range s.peers {
+		if !p.Dropped && p.Rate > best {
+			best = p.Rate
+		}
+	}
+	return st.Rate / best
+}
+
+// Allowance scales limit by the relative speed of peer, so that slower
+// peers get fewer chunks at a time.
+func (s *PeerStats) Allowance(peer string, limit int) int {
+	n := int(math.Round(float64(limit) * s.Speed(peer)))
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Print writes a per-peer summary of the download to w.
+func (s *PeerStats) Print(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]string, 0, len(s.peers))
+	for peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	p := cmn.NewPrinterWithWriter(w)
+	defer p.Flush()
+	p.Printf("Peer\tChunks\tBytes\tAvg rate\tLatency\tFailures\tStatus\n")
+	for _, peer := range peers {
+		st := s.peers[peer]
+		status := "ok"
+		if st.Dropped {
+			status = "dropped"
+		}
+		p.Printf("%s\t%d\t%d\t%.2f MB/s\t%v\t%d\t%s\n",
+			peer, st.Chunks, st.Bytes, st.AvgRate()/1e6, st.Latency.Round(time.Microsecond), st.Failures, status)
+	}
+}
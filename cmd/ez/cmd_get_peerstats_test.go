@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerStats(t *testing.T) {
+	t.Run("Ranking", func(t *testing.T) {
+		s := NewPeerStats([]string{"fast", "slow", "new"})
+		s.Success("fast", 100<<20, time.Second, time.Millisecond)
+		s.Success("slow", 25<<20, time.Second, time.Millisecond)
+		if v := s.Speed("fast"); v != 1 {
+			t.Fatal("fastest peer must have speed 1, got", v)
+		}
+		if v := s.Speed("slow"); v != 0.25 {
+			t.Fatal("expected speed 0.25, got", v)
+		}
+		if v := s.Speed("new"); v != 1 {
+			t.Fatal("peers not measured yet must have speed 1, got", v)
+		}
+		// the rate is a moving average, one fast chunk doesn't make the
+		// slow peer the fastest one
+		s.Success("slow", 200<<20, time.Second, time.Millisecond)
+		if v := s.Speed("slow"); v >= 1 || v <= 0.25 {
+			t.Fatal("expected speed between 0.25 and 1, got", v)
+		}
+	})
+	t.Run("Allowance", func(t *testing.T) {
+		s := NewPeerStats([]string{"fast", "slow", "slowest"})
+		s.Success("fast", 100<<20, time.Second, time.Millisecond)
+		s.Success("slow", 50<<20, time.Second, time.Millisecond)
+		s.Success("slowest", 1<<20, time.Second, time.Millisecond)
+		if n := s.Allowance("fast", 4); n != 4 {
+			t.Fatal("expected 4, got", n)
+		}
+		if n := s.Allowance("slow", 4); n != 2 {
+			t.Fatal("expected 2, got", n)
+		}
+		if n := s.Allowance("slowest", 4); n != 1 {
+			t.Fatal("every peer must be allowed one chunk, got", n)
+		}
+	})
+	t.Run("Drop", func(t *testing.T) {
+		s := NewPeerStats([]string{"a", "b"})
+		s.Success("a", 100<<20, time.Second, time.Millisecond)
+		s.Success("b", 50<<20, time.Second, time.Millisecond)
+		for i := 0; i < MAX_PEER_FAILURES-1; i++ {
+			if s.Failure("a") {
+				t.Fatal("peer dropped after", i+1, "failures")
+			}
+		}
+		// a success resets the consecutive failures
+		s.Success("a", 100<<20, time.Second, time.Millisecond)
+		for i := 0; i < MAX_PEER_FAILURES-1; i++ {
+			if s.Failure("a") {
+				t.Fatal("failures weren't reset by a success")
+			}
+		}
+		if !s.Failure("a") {
+			t.Fatal("peer wasn't dropped after", MAX_PEER_FAILURES, "consecutive failures")
+		}
+		// dropped peers don't count as the fastest one
+		if v := s.Speed("b"); v != 1 {
+			t.Fatal("expected b to be the fastest peer left, got", v)
+		}
+	})
+}
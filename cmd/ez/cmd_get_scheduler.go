@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// MAX_ENDGAME_COPIES is how many peers may fetch the same chunk at the same
+// time once there are no more pending chunks.
+const MAX_ENDGAME_COPIES = 2
+
+type chunkTask struct {
+	index    uint64
+	attempts int
+	failures map[string]int
+
+	// peers currently fetching the chunk, more than one only in endgame
+	fetchers map[string]bool
+	done     bool
+
+	// ctx is cancelled when the first copy of the chunk is complete
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// writer is set while a fetcher streams the chunk to the file, wmu
+	// serializes the writes to the chunk's region of the file
+	writer int32
+	wmu    sync.Mutex
+}
+
+// claimWriter returns true if the caller is the only one allowed to stream
+// the chunk to the file.
+func (t *chunkTask) claimWriter() bool {
+	return atomic.CompareAndSwapInt32(&t.writer, 0, 1)
+}
+
+func (t *chunkTask) releaseWriter() {
+	atomic.StoreInt32(&t.writer, 0)
+}
+
+// Scheduler hands out chunks to the peer workers of a download. A worker
+// asks for the next chunk as soon as it finished the previous one, so a slow
+// peer never holds back the others.
+//
+// When no chunk is pending anymore, the scheduler enters endgame: idle
+// workers get copies of the chunks still in flight and the first verified
+// copy wins.
+type Scheduler struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	pending      []*chunkTask
+	active       []*chunkTask
+	remaining    int
+	inflight     int
+	peerInflight map[string]int
+	peers        []string
+	dropped      map[string]bool
+	stats        *PeerStats
+	limit        uint64
+	err          error
+
+	maxInflight     int
+	maxPeerInflight int
+}
+
+// NewScheduler creates a scheduler for the given chunks. If stats is not nil,
+// the number of chunks a peer gets at a time is scaled by its speed.
+func NewScheduler(chunks []uint64, peers []string, stats *PeerStats, maxInflight, maxPeerInflight int) *Scheduler {
+	s := &Scheduler{
+		pending:         make([]*chunkTask, len(chunks)),
+		remaining:       len(chunks),
+		peerInflight:    make(map[string]int),
+		peers:           append([]string(nil), peers...),
+		dropped:         make(map[string]bool),
+		stats:           stats,
+		limit:           math.MaxUint64,
+		maxInflight:     maxInflight,
+		maxPeerInflight: maxPeerInflight,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for i, index := range chunks {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.pending[i] = &chunkTask{
+			index:    index,
+			failures: make(map[string]int),
+			fetchers: make(map[string]bool),
+			ctx:      ctx,
+			cancel:   cancel,
+		}
+	}
+	return s
+}
+
+// Next blocks until there is a chunk which can be fetched from peer. It
+// returns false when the download is finished or failed.
+func (s *Scheduler) Next(peer string) (*chunkTask, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.err != nil || s.remaining == 0 || s.dropped[peer] {
+			return nil, false
+		}
+		if s.inflight < s.maxInflight && s.peerInflight[peer] < s.peerLimit(peer) {
+			if i := s.pick(peer); i != -1 {
+				task := s.pending[i]
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				s.active = append(s.active, task)
+				s.acquire(task, peer)
+				return task, true
+			}
+			if len(s.pending) == 0 {
+				if task := s.pickEndgame(peer); task != nil {
+					s.acquire(task, peer)
+					return task, true
+				}
+			}
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *Scheduler) peerLimit(peer string) int {
+	if s.stats == nil {
+		return s.maxPeerInflight
+	}
+	return s.stats.Allowance(peer, s.maxPeerInflight)
+}
+
+// pick returns the index of the first pending chunk for which peer is one
+// of the peers that failed the least times, or -1 if there is none.
+func (s *Scheduler) pick(peer string) int {
+	for i, task := range s.pending {
+		if task.index >= s.limit || task.failures[peer] >= MAX_PEER_ATTEMPTS {
+			continue
+		}
+		if task.failures[peer] <= s.minFailures(task) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pickEndgame returns the in-flight chunk with the fewest copies which peer
+// is not already fetching, or nil if there is none.
+func (s *Scheduler) pickEndgame(peer string) *chunkTask {
+	var best *chunkTask
+	for _, task := range s.active {
+		if task.fetchers[peer] || task.failures[peer] >= MAX_PEER_ATTEMPTS {
+			continue
+		}
+		if len(task.fetchers) >= MAX_ENDGAME_COPIES {
+			continue
+		}
+		if best == nil || len(task.fetchers) < len(best.fetchers) {
+			best = task
+		}
+	}
+	return best
+}
+
+func (s *Scheduler) minFailures(task *chunkTask) int {
+	min := MAX_PEER_ATTEMPTS
+	for _, p := range s.peers {
+		if task.failures[p] < min {
+			min = task.failures[p]
+		}
+	}
+	return min
+}
+
+// Complete is called when peer fetched a verified copy of the chunk. It
+// returns true if this is the first copy, in which case the caller owns the
+// chunk and the other copies are cancelled.
+func (s *Scheduler) Complete(task *chunkTask, peer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release(task, peer)
+	s.cond.Broadcast()
+	if task.done {
+		return false
+	}
+	task.done = true
+	task.cancel()
+	s.deactivate(task)
+	s.remaining--
+	return true
+}
+
+// Abandon is called when peer stopped fetching a copy of the chunk because
+// another copy completed first.
+func (s *Scheduler) Abandon(task *chunkTask, peer string) {
+	s.mu.Lock()
+	s.release(task, peer)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Retry puts the chunk back in the queue after it failed on peer, unless
+// another peer is still fetching it. If every peer is exhausted for it, the
+// whole download fails.
+func (s *Scheduler) Retry(task *chunkTask, peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release(task, peer)
+	s.cond.Broadcast()
+	if task.done {
+		return
+	}
+	task.failures[peer]++
+	task.attempts++
+	if len(task.fetchers) != 0 {
+		return
+	}
+	s.deactivate(task)
+	if s.minFailures(task) >= MAX_PEER_ATTEMPTS {
+		if s.err == nil {
+			s.err = fmt.Errorf("chunk %d could not be downloaded from any peer", task.index)
+		}
+	} else {
+		s.pending = append(s.pending, task)
+	}
+}
+
+// SetLimit restricts the chunks handed out to the ones with an index lower
+// than limit.
+func (s *Scheduler) SetLimit(limit uint64) {
+	s.mu.Lock()
+	s.limit = limit
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Drop stops giving chunks to peer. The download fails if no peer is left.
+func (s *Scheduler) Drop(peer string) {
+	s.mu.Lock()
+	if !s.dropped[peer] {
+		s.dropped[peer] = true
+		for i := range s.peers {
+			if s.peers[i] == peer {
+				s.peers = append(s.peers[:i], s.peers[i+1:]...)
+				break
+			}
+		}
+		if len(s.peers) == 0 && s.err == nil {
+			s.err = fmt.Errorf("all peers were dropped")
+		}
+		for _, task := range s.pending {
+			if s.minFailures(task) >= MAX_PEER_ATTEMPTS && s.err == nil {
+				s.err = fmt.Errorf("chunk %d could not be downloaded from any peer", task.index)
+			}
+		}
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Fail stops the download with the given error.
+func (s *Scheduler) Fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Scheduler) acquire(task *chunkTask, peer string) {
+	task.fetchers[peer] = true
+	s.inflight++
+	s.peerInflight[peer]++
+}
+
+func (s *Scheduler) release(task *chunkTask, peer string) {
+	delete(task.fetchers, peer)
+	s.inflight--
+	s.peerInflight[peer]--
+}
+
+func (s *Scheduler) deactivate(task *chunkTask) {
+	for i := range s.active {
+		if s.active[i] == task {
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			return
+		}
+	}
+}
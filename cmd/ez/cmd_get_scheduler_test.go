@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestScheduler(t *testing.T) {
+	t.Run("RetryOnOtherPeer", func(t *testing.T) {
+		s := NewScheduler([]uint64{0}, []string{"a", "b"}, nil, 8, 1)
+		task, ok := s.Next("a")
+		if !ok {
+			t.Fatal("expected a chunk")
+		}
+		s.Retry(task, "a")
+		task, ok = s.Next("b")
+		if !ok || task.index != 0 {
+			t.Fatal("expected chunk 0 to be retried on b")
+		}
+		s.Complete(task, "b")
+		if _, ok := s.Next("a"); ok {
+			t.Fatal("expected the download to be finished")
+		}
+		if err := s.Err(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("Exhausted", func(t *testing.T) {
+		s := NewScheduler([]uint64{0}, []string{"a"}, nil, 8, 1)
+		for i := 0; i < MAX_PEER_ATTEMPTS; i++ {
+			task, ok := s.Next("a")
+			if !ok {
+				t.Fatal("expected a chunk")
+			}
+			s.Retry(task, "a")
+		}
+		if _, ok := s.Next("a"); ok {
+			t.Fatal("expected the download to fail")
+		}
+		if s.Err() == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("PeerLimit", func(t *testing.T) {
+		s := NewScheduler([]uint64{0, 1, 2}, []string{"a", "b"}, nil, 8, 1)
+		first, _ := s.Next("a")
+		second, _ := s.Next("b")
+		if first.index != 0 || second.index != 1 {
+			t.Fatalf("unexpected chunks %d, %d", first.index, second.index)
+		}
+		s.Complete(first, "a")
+		third, _ := s.Next("a")
+		if third.index != 2 {
+			t.Fatalf("expected chunk 2, got %d", third.index)
+		}
+	})
+	t.Run("Endgame", func(t *testing.T) {
+		s := NewScheduler([]uint64{0}, []string{"a", "b"}, nil, 8, 1)
+		first, _ := s.Next("a")
+		dup, ok := s.Next("b")
+		if !ok || dup != first {
+			t.Fatal("expected b to get a copy of chunk 0")
+		}
+		if !s.Complete(dup, "b") {
+			t.Fatal("expected the first copy to win")
+		}
+		if first.ctx.Err() == nil {
+			t.Fatal("expected the other copy to be cancelled")
+		}
+		if s.Complete(first, "a") {
+			t.Fatal("expected the second copy to lose")
+		}
+		if _, ok := s.Next("a"); ok {
+			t.Fatal("expected the download to be finished")
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Session shares one connection per peer between the downloads of several
+// files, each download opening its file on it as a separate stream. Peers
+// which don't support handles get a connection per download, as before.
+type Session struct {
+	mu    sync.Mutex
+	conns map[string]*SeederClient
+	dial  ConnPoolDialFunc
+}
+
+func NewSession() *Session {
+	return &Session{conns: make(map[string]*SeederClient), dial: NewLegacyPeers().Dial}
+}
+
+// Dial returns a client for addr, which can be used as a ConnPoolDialFunc.
+// The peer is dialed without holding the lock, so that a slow peer doesn't
+// hold back the downloads from the others.
+func (s *Session) Dial(addr string) (*SeederClient, error) {
+	if c := s.shared(addr); c != nil {
+		return c, nil
+	}
+	c, err := s.dial(addr)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if !c.Streams() {
+		return c, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.conns[addr]; old != nil {
+		if old.Err() == nil {
+			// another download connected to addr meanwhile
+			c.Close()
+			return old.Stream(), nil
+		}
+		old.Close()
+	}
+	s.conns[addr] = c
+	return c.Stream(), nil
+}
+
+// shared returns a stream on the connection to addr, or nil if there is no
+// usable one.
+func (s *Session) shared(addr string) *SeederClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.conns[addr]
+	if c == nil {
+		return nil
+	}
+	if c.Err() == nil {
+		return c.Stream()
+	}
+	c.Close()
+	delete(s.conns, addr)
+	return nil
+}
+
+// Close releases the connections of the session, each one is closed when the
+// last download which uses it is done with it.
+func (s *Session) Close() {
+	s.mu.Lock()
+	for addr, c := range s.conns {
+		c.Close()
+		delete(s.conns, addr)
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aburdulescu/ez/cmn"
+	"github.com/aburdulescu/ez/swp"
+)
+
+// TestSession checks that the downloads of a session share one connection
+// to a peer which supports handles, each with its own file.
+func TestSession(t *testing.T) {
+	fQuiet = true
+	run := func(t *testing.T, s *fakeSeeder) {
+		session := &Session{conns: make(map[string]*SeederClient), dial: s.Dial}
+		defer session.Close()
+		cfg := testDownloaderConfig(s)
+		cfg.Dir = t.TempDir()
+		cfg.Dial = session.Dial
+		download := func(name string) error {
+			return NewDownloader(cfg).Run(s.id, s.ifile(name), []string{"peer"})
+		}
+		if err := download("first.bin"); err != nil {
+			t.Fatal(err)
+		}
+		names := []string{"second.bin", "third.bin"}
+		errs := make(chan error, len(names))
+		for _, name := range names {
+			go func(name string) { errs <- download(name) }(name)
+		}
+		for range names {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range append(names, "first.bin") {
+			checkFile(t, filepath.Join(cfg.Dir, name), s.data)
+		}
+	}
+
+	t.Run("Handles", func(t *testing.T) {
+		s := newFakeSeeder(t, 2*cmn.ChunkSize+1000)
+		s.caps |= swp.CapHandles
+		run(t, s)
+		if s.Dials() != 1 {
+			t.Fatal("expected one connection, got", s.Dials())
+		}
+		if s.Handles() != 0 {
+			t.Fatal("files left open:", s.Handles())
+		}
+	})
+
+	t.Run("NoHandles", func(t *testing.T) {
+		s := newFakeSeeder(t, 2*cmn.ChunkSize+1000)
+		run(t, s)
+		if s.Dials() < 3 {
+			t.Fatal("expected a connection per download, got", s.Dials())
+		}
+	})
+
+	t.Run("ConcurrentDial", func(t *testing.T) {
+		s := newFakeSeeder(t, cmn.ChunkSize)
+		s.caps |= swp.CapHandles
+		var arrived sync.WaitGroup
+		arrived.Add(2)
+		both := make(chan struct{})
+		go func() {
+			arrived.Wait()
+			close(both)
+		}()
+		dial := func(addr string) (*SeederClient, error) {
+			// the other dial can't start while this one holds the lock
+			arrived.Done()
+			select {
+			case <-both:
+			case <-time.After(time.Second):
+				return nil, errors.New("peer dialed with the session locked")
+			}
+			return s.Dial(addr)
+		}
+		session := &Session{conns: make(map[string]*SeederClient), dial: dial}
+		defer session.Close()
+		clients := make(chan *SeederClient, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				c, err := session.Dial("peer")
+				if err != nil {
+					t.Error(err)
+				}
+				clients <- c
+			}()
+		}
+		a, b := <-clients, <-clients
+		if a == nil || b == nil {
+			t.FailNow()
+		}
+		defer a.Close()
+		defer b.Close()
+		if a.mux != b.mux {
+			t.Fatal("the downloads don't share the connection")
+		}
+		for _, c := range []*SeederClient{a, b} {
+			if err := c.Connect(s.id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if s.Handles() != 2 {
+			t.Fatal("expected 2 open files, got", s.Handles())
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"log"
+)
+
+// streamChunk is a verified chunk waiting to be written to the output
+// stream.
+type streamChunk struct {
+	index uint64
+	buf   ChunkBuffer
+	n     int64
+}
+
+// stream downloads the file and writes it in order to w. Chunks may arrive
+// out of order from different peers, so they are kept in memory until all
+// the chunks before them were written; the scheduler doesn't hand out chunks
+// more than d.window chunks ahead of the next one to be written, which bounds
+// the memory used.
+func (d *Downloader) stream(w io.Writer, size int64) error {
+	chunks := make([]uint64, chunkCount(size))
+	for i := range chunks {
+		chunks[i] = uint64(i)
+	}
+
+	d.window = uint64(d.cfg.MaxInflight)
+	d.out = make(chan streamChunk, d.window)
+	done := make(chan error, 1)
+	go d.reorder(w, done)
+
+	err := d.download(size, chunks)
+	close(d.out)
+	if werr := <-done; werr != nil && err == nil {
+		err = werr
+	}
+	return err
+}
+
+// reorder writes the chunks received on d.out to w in order.
+func (d *Downloader) reorder(w io.Writer, done chan<- error) {
+	var werr error
+	pending := make(map[uint64]streamChunk)
+	next := uint64(0)
+	for c := range d.out {
+		pending[c.index] = c
+		for {
+			c, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if werr == nil {
+				if _, err := w.Write(c.buf[:c.n]); err != nil {
+					log.Println(err)
+					werr = FatalError{err}
+					d.sched.Fail(werr)
+				}
+			}
+			ReleaseChunk(c.buf)
+			next++
+			d.sched.SetLimit(next + d.window)
+		}
+	}
+	for _, c := range pending {
+		ReleaseChunk(c.buf)
+	}
+	done <- werr
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aburdulescu/ez/cmn"
+)
+
+// countingWriter tells how many bytes were written so far.
+type countingWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *countingWriter) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Len()
+}
+
+func TestStream(t *testing.T) {
+	fQuiet = true
+	const window = 2
+	s := newFakeSeeder(t, 4*cmn.ChunkSize+1000)
+	w := &countingWriter{}
+
+	var mu sync.Mutex
+	var order []uint64
+	s.delay = func(index uint64) time.Duration {
+		// the reorder buffer may only be ahead of the written output by
+		// the window
+		if next := uint64(w.Len() / cmn.ChunkSize); index >= next+window {
+			t.Errorf("chunk %d requested while chunk %d is the next one to write", index, next)
+		}
+		if index == 0 {
+			return 200 * time.Millisecond
+		}
+		return 0
+	}
+	s.sent = func(index uint64) {
+		mu.Lock()
+		order = append(order, index)
+		mu.Unlock()
+	}
+
+	d := NewDownloader(DownloaderConfig{
+		MaxInflight:     window,
+		MaxPeerInflight: window,
+		Output:          "-",
+		Dial:            s.Dial,
+	})
+	d.id = s.id
+	size := int64(len(s.data))
+	if err := d.connect([]string{"peer"}, size); err != nil {
+		t.Fatal(err)
+	}
+	defer d.disconnect()
+	if err := d.stream(w, size); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(w.buf.Bytes(), s.data) {
+		t.Fatal("streamed output differs from the shared file")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) < 2 || order[0] != 1 {
+		t.Fatalf("expected chunk 1 to arrive before chunk 0, got %v", order)
+	}
+}
@@ -1,28 +1,57 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/aburdulescu/ez/cmn"
 	"github.com/aburdulescu/ez/ezt"
 )
 
 func onLs(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	var q ezt.Query
+	fs.StringVar(&q.Name, "name", "", "list the files whose name contains this, ignoring case")
+	fs.StringVar(&q.Glob, "glob", "", "list the files whose name matches this glob pattern")
+	fs.StringVar(&q.Regex, "regex", "", "list the files whose name matches this regular expression")
+	var tags cmn.Strings
+	fs.Var(&tags, "tag", "list the files which have this tag, can be repeated or hold more tags separated by commas")
+	fs.Int64Var(&q.MinSize, "min-size", 0, "list the files with at least this many bytes")
+	fs.Int64Var(&q.MaxSize, "max-size", 0, "list the files with at most this many bytes, 0 for no limit")
+	fs.StringVar(&q.Sort, "sort", ezt.SortName, "sort by name, size, peers or added, prefixed with - for descending order")
+	fs.IntVar(&q.Limit, "limit", 0, "max number of files listed, 0 for all")
+	fs.StringVar(&q.Cursor, "cursor", "", "list the page which starts at this cursor, printed after the previous one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	q.Tags = tags
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if err := q.Validate(); err != nil {
+		return err
+	}
 	trackerURL, err := getTrackerURL()
 	if err != nil {
 		return err
 	}
 	trackerClient := ezt.NewClient(trackerURL)
-	rsp, err := trackerClient.GetAll()
+	rsp, err := trackerClient.List(q)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 	p := cmn.NewPrinter()
-	defer p.Flush()
-	p.Printf("ID\tFilename\tSize\n")
+	p.Printf("ID\tFilename\tSize\tTags\tDescription\n")
 	for _, f := range rsp.Files {
-		p.Printf("%s\t%s\t%d\n", f.Id, f.Name, f.Size)
+		p.Printf("%s\t%s\t%d\t%s\t%s\n", f.Id, f.Name, f.Size, strings.Join(f.Tags, ","), f.Desc)
+	}
+	p.Flush()
+	if rsp.Next != "" {
+		fmt.Fprintln(os.Stderr, "next page: -cursor", rsp.Next)
 	}
 	return nil
 }
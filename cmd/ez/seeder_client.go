@@ -1,11 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aburdulescu/ez/cmn"
 	"github.com/aburdulescu/ez/swp"
@@ -13,123 +17,548 @@ import (
 
 var chunkPool = sync.Pool{
 	New: func() interface{} {
-		buf := new(bytes.Buffer)
-		buf.Grow(cmn.ChunkSize)
-		return buf
+		return make(ChunkBuffer, cmn.ChunkSize)
 	},
 }
 
-func AllocChunk() *bytes.Buffer {
-	return chunkPool.Get().(*bytes.Buffer)
+// ChunkBuffer holds a whole chunk in memory, for the cases when it can't be
+// written directly to its final place.
+type ChunkBuffer []byte
+
+func AllocChunk() ChunkBuffer {
+	return chunkPool.Get().(ChunkBuffer)
+}
+
+func ReleaseChunk(b ChunkBuffer) {
+	chunkPool.Put(b[:cmn.ChunkSize])
+}
+
+func (b ChunkBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(b)) {
+		return 0, fmt.Errorf("write outside of chunk buffer")
+	}
+	return copy(b[off:], p), nil
+}
+
+var (
+	ErrUnknownId    = errors.New("seeder doesn't share the file")
+	ErrSeederIO     = errors.New("seeder could not read the file")
+	ErrOutOfRange   = errors.New("chunk out of range")
+	ErrNotConnected = errors.New("seeder expected CONNECT first")
+	ErrBusy         = errors.New("seeder is busy")
+	ErrNoChecksums  = errors.New("seeder doesn't support GETCHECKSUMS")
+	// ErrTimeout is returned when the seeder doesn't answer in time, the
+	// request can be retried with another seeder
+	ErrTimeout = errors.New("seeder timed out")
+)
+
+// SeederError is a failure reported by the seeder with an ERROR message. The
+// connection can still be used after it.
+type SeederError struct {
+	Code swp.ErrCode
+	Text string
 }
 
-func ReleaseChunk(b *bytes.Buffer) {
-	b.Reset()
-	chunkPool.Put(b)
+func (e SeederError) Error() string {
+	return "seeder: " + swp.Error{Code: e.Code, Text: e.Text}.Error()
 }
 
+func (e SeederError) Unwrap() error {
+	switch e.Code {
+	case swp.ERR_UNKNOWN_ID:
+		return ErrUnknownId
+	case swp.ERR_IO:
+		return ErrSeederIO
+	case swp.ERR_OUT_OF_RANGE:
+		return ErrOutOfRange
+	case swp.ERR_NOT_CONNECTED:
+		return ErrNotConnected
+	case swp.ERR_BUSY:
+		return ErrBusy
+	default:
+		return nil
+	}
+}
+
+// unexpected returns the error for a response which is not the expected one.
+func unexpected(rsp swp.Msg) error {
+	if rsp.Type() == swp.ERROR {
+		e := rsp.(swp.Error)
+		return SeederError{Code: e.Code, Text: e.Text}
+	}
+	return fmt.Errorf("unexpected response: %s", rsp.Type())
+}
+
+// HELLO_TIMEOUT is how long to wait for the answer to HELLO. Seeders older
+// than the handshake ignore it, so no answer means a legacy seeder.
+const HELLO_TIMEOUT = 2 * time.Second
+
+// OP_TIMEOUT is the default time to wait for each response of the seeder,
+// or for a request to be sent.
+const OP_TIMEOUT = 30 * time.Second
+
+// KEEPALIVE_INTERVAL is how long a multiplexed connection can be quiet
+// before it's checked with a PING, if the seeder supports it.
+const KEEPALIVE_INTERVAL = 15 * time.Second
+
+// fTimeout is the time to wait for each response of the seeder, 0 to wait
+// forever.
+var fTimeout = OP_TIMEOUT
+
+// SeederClient is a connection to a seeder. If the seeder supports request
+// ids, the connection is multiplexed and can be used by many goroutines at
+// the same time, otherwise by one at a time. If the seeder supports handles
+// too, the connection can be shared by clients for different files, see
+// Stream.
 type SeederClient struct {
-	conn net.Conn
+	latency int64 // first, to be 64-bit aligned for atomic
+	conn    net.Conn
+	wire    *swp.Conn
+	proto   swp.Hello
+
+	muxed   bool
+	mux     *muxState
+	timeout time.Duration
+
+	// stream is set for the clients returned by Stream, which open their
+	// file with OPEN and send its handle in the requests
+	stream bool
+	handle swp.Handle
+	closed bool
 }
 
 func DialSeederClient(addr string) (*SeederClient, error) {
-	conn, err := net.Dial("tcp", addr)
+	return dialSeederClient(addr, false)
+}
+
+// dialSeederClient connects to addr. If legacy is true, the seeder is known
+// not to answer HELLO, so the handshake is skipped instead of waiting
+// HELLO_TIMEOUT for nothing.
+func dialSeederClient(addr string, legacy bool) (*SeederClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, fTimeout)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
-	c := &SeederClient{conn: conn}
+	c := &SeederClient{conn: conn, wire: swp.NewConn(conn), timeout: fTimeout}
+	c.wire.SetWriteTimeout(fTimeout)
+	if legacy {
+		c.proto = swp.Legacy()
+		return c, nil
+	}
+	if err := c.hello(); err != nil {
+		log.Println(err)
+		conn.Close()
+		return nil, err
+	}
 	return c, nil
 }
 
-func (c SeederClient) Close() {
+// hello negotiates the protocol version and capabilities with the seeder.
+func (c *SeederClient) hello() error {
+	local := swp.NewHello("ez", swp.DefaultMaxFrame)
+	if err := c.wire.Send(local); err != nil {
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(HELLO_TIMEOUT))
+	rsp, cleanup, err := c.wire.Recv()
+	c.conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		log.Printf("%s didn't answer HELLO, assuming a legacy seeder", c.conn.RemoteAddr())
+		c.proto = swp.Legacy()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if rsp.Type() != swp.HELLO {
+		return unexpected(rsp)
+	}
+	proto, err := swp.Negotiate(local, rsp.(swp.Hello))
+	if err != nil {
+		return err
+	}
+	c.proto = proto
+	c.wire.SetFraming(swp.FramingFor(proto))
+	if proto.Caps.Has(swp.CapRequestIds) {
+		c.muxed = true
+		c.mux = &muxState{pending: make(map[uint32]*exchange), refs: 1}
+		c.mux.lastRecv = time.Now().UnixNano()
+		go c.readLoop()
+		if proto.Caps.Has(swp.CapKeepalive) && c.timeout > 0 {
+			go c.keepalive()
+		}
+	}
+	return nil
+}
+
+// Proto returns the protocol version and capabilities agreed with the seeder.
+func (c *SeederClient) Proto() swp.Hello {
+	return c.proto
+}
+
+// Legacy returns true if the seeder didn't answer HELLO.
+func (c *SeederClient) Legacy() bool {
+	return c.proto.Version == 0
+}
+
+// Streams returns true if the connection can be shared by clients for
+// different files.
+func (c *SeederClient) Streams() bool {
+	return c.muxed && c.proto.Caps.Has(swp.CapHandles)
+}
+
+// Stream returns a new client which shares the connection with c but has its
+// own file, opened with Connect. The connection is closed when all the
+// clients which use it are closed. Streams must be true.
+func (c *SeederClient) Stream() *SeederClient {
+	c.mux.mu.Lock()
+	c.mux.refs++
+	c.mux.mu.Unlock()
+	return &SeederClient{
+		conn:    c.conn,
+		wire:    c.wire,
+		proto:   c.proto,
+		muxed:   c.muxed,
+		mux:     c.mux,
+		timeout: c.timeout,
+		stream:  true,
+	}
+}
+
+func (c *SeederClient) Close() {
 	if c.conn == nil {
 		return
 	}
+	if c.mux != nil {
+		c.mux.mu.Lock()
+		if c.closed {
+			c.mux.mu.Unlock()
+			return
+		}
+		c.closed = true
+		c.mux.refs--
+		last := c.mux.refs == 0
+		c.mux.mu.Unlock()
+		if !last {
+			return
+		}
+	}
 	c.conn.Close()
 }
 
-func (c SeederClient) Connect(id string) error {
-	if c.conn == nil {
-		return fmt.Errorf("client was not initialized properly")
+func (c *SeederClient) Connect(id string) error {
+	if c.stream {
+		return c.open(id)
 	}
-	if err := swp.Send(c.conn, swp.Connect{id}); err != nil {
+	x, err := c.request(swp.Connect{Id: id})
+	if err != nil {
 		log.Println(err)
 		return err
 	}
-	rsp, cleanup, err := swp.Recv(c.conn)
+	defer x.done()
+	rsp, cleanup, err := x.recv(context.Background())
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 	defer cleanup()
-	rspType := rsp.Type()
-	if rspType != swp.ACK {
-		return fmt.Errorf("unexpected response: %s", rspType)
+	if rsp.Type() != swp.ACK {
+		return unexpected(rsp)
 	}
 	return nil
 }
 
-func (c SeederClient) Disconnect() error {
-	if c.conn == nil {
-		return fmt.Errorf("client was not initialized properly")
+// open opens the file of a stream, closing the previous one.
+func (c *SeederClient) open(id string) error {
+	if c.handle != 0 {
+		if err := c.Disconnect(); err != nil {
+			return err
+		}
 	}
-	if err := swp.Send(c.conn, swp.Disconnect{}); err != nil {
+	x, err := c.request(swp.Open{Id: id})
+	if err != nil {
 		log.Println(err)
 		return err
 	}
-	rsp, cleanup, err := swp.Recv(c.conn)
+	defer x.done()
+	rsp, cleanup, err := x.recv(context.Background())
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 	defer cleanup()
-	rspType := rsp.Type()
-	if rspType != swp.DISCONNECT {
-		return fmt.Errorf("unexpected response: %s", rspType)
+	if rsp.Type() != swp.OPENED {
+		return unexpected(rsp)
 	}
+	c.handle = rsp.(swp.Opened).Handle
 	return nil
 }
 
-func (c SeederClient) Getchunk(index uint64) (*bytes.Buffer, error) {
-	if c.conn == nil {
-		return nil, fmt.Errorf("client was not initialized properly")
+func (c *SeederClient) Disconnect() error {
+	var req swp.Msg = swp.Disconnect{}
+	if c.stream {
+		if c.handle == 0 {
+			return nil
+		}
+		req = swp.Close{Handle: c.handle}
+		c.handle = 0
 	}
-	if err := swp.Send(c.conn, swp.Getchunk{index}); err != nil {
+	x, err := c.request(req)
+	if err != nil {
 		log.Println(err)
-		return nil, err
+		return err
 	}
-	rsp, cleanup, err := swp.Recv(c.conn)
+	defer x.done()
+	rsp, cleanup, err := x.recv(context.Background())
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		return err
+	}
+	defer cleanup()
+	if rsp.Type() != swp.ACK {
+		return unexpected(rsp)
+	}
+	return nil
+}
+
+// Latency returns the time the peer took to start answering the last
+// GETCHUNK request.
+func (c *SeederClient) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.latency))
+}
+
+// Getchunk downloads the chunk with the given index, writing every piece to
+// w at its offset inside the chunk as soon as it arrives. The checksum is
+// computed along the way and an error is returned if it doesn't match the
+// expected one, in which case the data written to w must be discarded. If
+// ctx is cancelled during the transfer, the rest of the chunk is cancelled or
+// drained so that the connection can be reused, and ctx.Err() is returned.
+func (c *SeederClient) Getchunk(ctx context.Context, index uint64, expected cmn.Checksum, w io.WriterAt) (int64, error) {
+	start := time.Now()
+	x, err := c.request(swp.Getchunk{Index: index, Handle: c.handle})
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	defer x.done()
+	info, err := c.recvChunkinfo(ctx, x)
+	if err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&c.latency, int64(time.Since(start)))
+	n, sum, err := c.recvPieces(ctx, x, info.NPieces, w)
+	if err != nil {
+		return 0, err
+	}
+	if sum != expected {
+		return 0, fmt.Errorf("checksum of chunk %d differs from the expected one", index)
+	}
+	return n, nil
+}
+
+// Getrange downloads length bytes of the file starting at offset and writes
+// them to w as they arrive, returning how many bytes there were: less than
+// length if the range goes past the end of the file. The data is checked only
+// against the checksum sent by the seeder, which catches transfer errors but
+// doesn't prove that the content belongs to the file; if an error is
+// returned, what was written to w must be discarded.
+func (c *SeederClient) Getrange(ctx context.Context, offset, length uint64, w io.Writer) (int64, error) {
+	if !c.proto.Caps.Has(swp.CapRange) {
+		return 0, fmt.Errorf("seeder doesn't support GETRANGE")
+	}
+	x, err := c.request(swp.Getrange{Offset: offset, Length: length, Handle: c.handle})
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	defer x.done()
+	info, err := c.recvChunkinfo(ctx, x)
+	if err != nil {
+		return 0, err
+	}
+	n, sum, err := c.recvPieces(ctx, x, info.NPieces, seqWriter{w})
+	if err != nil {
+		return 0, err
+	}
+	if uint64(n) > length {
+		return 0, fmt.Errorf("seeder sent %d bytes instead of %d", n, length)
+	}
+	if sum != cmn.Checksum(info.Checksum) {
+		return 0, fmt.Errorf("checksum of range %d+%d differs from the one sent by the seeder", offset, n)
+	}
+	return n, nil
+}
+
+func (c *SeederClient) recvChunkinfo(ctx context.Context, x *exchange) (swp.Chunkinfo, error) {
+	rsp, cleanup, err := x.recv(ctx)
+	if err != nil && c.muxed && ctx.Err() != nil {
+		if err := c.drain(x, 0); err != nil {
+			return swp.Chunkinfo{}, err
+		}
+		return swp.Chunkinfo{}, ctx.Err()
+	}
+	if err != nil {
+		log.Println(err)
+		return swp.Chunkinfo{}, err
 	}
 	defer cleanup()
-	rspType := rsp.Type()
-	if rspType != swp.CHUNKINFO {
-		return nil, fmt.Errorf("unexpected response: %s", rspType)
+	if rsp.Type() != swp.CHUNKINFO {
+		return swp.Chunkinfo{}, unexpected(rsp)
 	}
-	chunkinfoMsg := rsp.(swp.Chunkinfo)
-	npieces := chunkinfoMsg.NPieces
-	buf := AllocChunk()
+	return rsp.(swp.Chunkinfo), nil
+}
+
+// recvPieces writes npieces pieces to w at their offset, up to one chunk in
+// total, and returns their size and checksum. If ctx is cancelled during the
+// transfer, the request is cancelled or its remaining pieces are drained, so
+// that the connection can be reused, and ctx.Err() is returned.
+func (c *SeederClient) recvPieces(ctx context.Context, x *exchange, npieces uint64, w io.WriterAt) (int64, cmn.Checksum, error) {
+	digest := cmn.NewDigest()
+	var off int64
 	for i := uint64(0); i < npieces; i++ {
-		rsp, cleanup, err := swp.Recv(c.conn)
+		if ctx.Err() != nil {
+			if err := c.drain(x, npieces-i); err != nil {
+				return 0, 0, err
+			}
+			return 0, 0, ctx.Err()
+		}
+		rsp, cleanup, err := x.recv(ctx)
+		if err != nil && c.muxed && ctx.Err() != nil {
+			if err := c.drain(x, npieces-i); err != nil {
+				return 0, 0, err
+			}
+			return 0, 0, ctx.Err()
+		}
 		if err != nil {
 			log.Println(err)
-			return nil, err
+			return 0, 0, err
 		}
-		pieceMsg := rsp.(swp.Piece)
-		if _, err := buf.Write(pieceMsg.Piece); err != nil {
+		if rsp.Type() != swp.PIECE {
 			cleanup()
+			return 0, 0, unexpected(rsp)
+		}
+		piece := rsp.(swp.Piece).Piece
+		if off+int64(len(piece)) > cmn.ChunkSize {
+			cleanup()
+			return 0, 0, fmt.Errorf("seeder sent more than a chunk")
+		}
+		if _, err := w.WriteAt(piece, off); err != nil {
+			cleanup()
+			if ctx.Err() != nil {
+				if err := c.drain(x, npieces-i-1); err != nil {
+					return 0, 0, err
+				}
+				return 0, 0, ctx.Err()
+			}
+			return 0, 0, err
+		}
+		digest.Write(piece)
+		off += int64(len(piece))
+		cleanup()
+	}
+	return off, digest.Sum(), nil
+}
+
+// seqWriter writes the pieces of a range, which arrive in order, to a plain
+// writer.
+type seqWriter struct {
+	w io.Writer
+}
+
+func (w seqWriter) WriteAt(p []byte, off int64) (int, error) {
+	return w.w.Write(p)
+}
+
+// Getchecksums returns the checksums of all the nchunks chunks of the
+// connected file, as the peer claims them to be. A peer which claims another
+// number of chunks is rejected before its checksums are kept.
+func (c *SeederClient) Getchecksums(nchunks uint64) ([]cmn.Checksum, error) {
+	if !c.proto.Caps.Has(swp.CapChecksums) {
+		return nil, ErrNoChecksums
+	}
+	var checksums []cmn.Checksum
+	for {
+		x, err := c.request(swp.Getchecksums{Start: uint64(len(checksums)), Handle: c.handle})
+		if err != nil {
+			log.Println(err)
 			return nil, err
 		}
+		rsp, cleanup, err := x.recv(context.Background())
+		x.done()
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		cleanup()
+		if rsp.Type() != swp.CHECKSUMS {
+			return nil, unexpected(rsp)
+		}
+		checksumsMsg := rsp.(swp.Checksums)
+		if checksumsMsg.Total != nchunks {
+			return nil, fmt.Errorf("peer has %d checksums instead of %d", checksumsMsg.Total, nchunks)
+		}
+		if uint64(len(checksums)+len(checksumsMsg.Checksums)) > nchunks {
+			return nil, fmt.Errorf("peer sent more than %d checksums", nchunks)
+		}
+		for _, checksum := range checksumsMsg.Checksums {
+			checksums = append(checksums, cmn.Checksum(checksum))
+		}
+		if uint64(len(checksums)) >= checksumsMsg.Total {
+			break
+		}
+		if len(checksumsMsg.Checksums) == 0 {
+			return nil, fmt.Errorf("peer sent %d checksums out of %d", len(checksums), checksumsMsg.Total)
+		}
+	}
+	return checksums, nil
+}
+
+// drain gets rid of the rest of the answer to x, of which n pieces are left.
+// If the seeder supports CANCEL, it's asked to stop sending them. Otherwise
+// the responses to a multiplexed request are dropped by readLoop once the
+// exchange is done, so there is nothing to drain, and the pieces sent on a
+// plain connection are read and discarded.
+func (c *SeederClient) drain(x *exchange, n uint64) error {
+	if c.proto.Caps.Has(swp.CapCancel) {
+		return c.cancel(x)
+	}
+	if c.muxed {
+		return nil
+	}
+	for i := uint64(0); i < n; i++ {
+		rsp, cleanup, err := x.recv(context.Background())
+		if err != nil {
+			log.Println(err)
+			return err
+		}
 		cleanup()
+		if rsp.Type() != swp.PIECE {
+			return unexpected(rsp)
+		}
 	}
-	calcChecksum := cmn.NewChecksum(buf.Bytes())
-	checksum := cmn.Checksum(chunkinfoMsg.Checksum)
-	if calcChecksum != checksum {
-		// TODO: don't return err, retry download from other peer(or maybe the same peer?)
-		return nil, fmt.Errorf("checksum of chunk %d differs from checksum provided by peer", index)
+	return nil
+}
+
+// cancel sends CANCEL for x and discards its responses until the seeder
+// acknowledges it, after which the seeder doesn't send anything else for x.
+func (c *SeederClient) cancel(x *exchange) error {
+	if err := c.wire.SendTagged(x.tag, swp.Cancel{}); err != nil {
+		log.Println(err)
+		c.abort(err)
+		return err
+	}
+	for {
+		rsp, cleanup, err := x.recv(context.Background())
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		cleanup()
+		if rsp.Type() == swp.ACK {
+			return nil
+		}
 	}
-	return buf, nil
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aburdulescu/ez/swp"
+)
+
+// MUX_QUEUE is how many responses of a request are queued before the
+// reader of the connection waits for them to be consumed.
+const MUX_QUEUE = 16
+
+// muxState is the state of a multiplexed connection, shared by the clients
+// which use it for different files.
+type muxState struct {
+	lastRecv int64 // first, to be 64-bit aligned for atomic
+
+	mu      sync.Mutex
+	nextTag uint32
+	pending map[uint32]*exchange
+	err     error
+	// refs counts the clients which use the connection, it's closed when
+	// the last one is closed
+	refs int
+}
+
+// exchange is a request sent to the seeder together with the responses to
+// it. When the connection is multiplexed the responses are delivered by
+// readLoop, otherwise they are read directly from the connection.
+type exchange struct {
+	c    *SeederClient
+	tag  uint32
+	rsps chan response
+	quit chan struct{}
+}
+
+type response struct {
+	msg     swp.Msg
+	cleanup func()
+}
+
+// request sends msg and returns the exchange on which its responses arrive.
+// The caller must call done when it doesn't need more responses.
+func (c *SeederClient) request(msg swp.Msg) (*exchange, error) {
+	if c.conn == nil {
+		return nil, errors.New("client was not initialized properly")
+	}
+	x := &exchange{c: c}
+	if c.muxed {
+		c.mux.mu.Lock()
+		if c.mux.err != nil {
+			c.mux.mu.Unlock()
+			return nil, c.mux.err
+		}
+		c.mux.nextTag++
+		x.tag = c.mux.nextTag
+		x.rsps = make(chan response, MUX_QUEUE)
+		x.quit = make(chan struct{})
+		c.mux.pending[x.tag] = x
+		c.mux.mu.Unlock()
+	}
+	if err := c.wire.SendTagged(x.tag, msg); err != nil {
+		x.done()
+		if c.muxed {
+			// part of the frame may have been sent, the other requests
+			// can't use the connection anymore
+			c.abort(err)
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w: %v", ErrTimeout, err)
+		}
+		return nil, err
+	}
+	return x, nil
+}
+
+// recv returns the next response, or ErrTimeout if it doesn't come in time.
+// On a multiplexed connection it stops waiting when ctx is cancelled.
+func (x *exchange) recv(ctx context.Context) (swp.Msg, func(), error) {
+	c := x.c
+	if x.rsps == nil {
+		if c.timeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		msg, cleanup, err := c.wire.Recv()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, nil, fmt.Errorf("%w: %v", ErrTimeout, err)
+		}
+		return msg, cleanup, err
+	}
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case rsp, ok := <-x.rsps:
+		if !ok {
+			return nil, nil, c.Err()
+		}
+		return rsp.msg, rsp.cleanup, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-timeout:
+		return nil, nil, fmt.Errorf("%w: no answer to request %d after %v", ErrTimeout, x.tag, c.timeout)
+	}
+}
+
+// done ends the exchange, the responses which still come for it are dropped.
+func (x *exchange) done() {
+	if x.rsps == nil {
+		return
+	}
+	c := x.c
+	c.mux.mu.Lock()
+	if c.mux.pending[x.tag] == x {
+		delete(c.mux.pending, x.tag)
+		close(x.quit)
+	}
+	c.mux.mu.Unlock()
+	for {
+		select {
+		case rsp, ok := <-x.rsps:
+			if !ok {
+				return
+			}
+			rsp.cleanup()
+		default:
+			return
+		}
+	}
+}
+
+// readLoop delivers the responses read from a multiplexed connection to the
+// exchanges they belong to, until the connection fails or is closed.
+func (c *SeederClient) readLoop() {
+	for {
+		tag, msg, cleanup, err := c.wire.RecvTagged()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		atomic.StoreInt64(&c.mux.lastRecv, time.Now().UnixNano())
+		c.mux.mu.Lock()
+		x := c.mux.pending[tag]
+		c.mux.mu.Unlock()
+		if x == nil {
+			cleanup()
+			continue
+		}
+		select {
+		case x.rsps <- response{msg: msg, cleanup: cleanup}:
+		case <-x.quit:
+			cleanup()
+		}
+	}
+}
+
+// keepalive sends a PING when the connection has been quiet for
+// KEEPALIVE_INTERVAL and closes it if the seeder doesn't answer anything for
+// another interval, so that a dead seeder fails the requests waiting for it
+// instead of letting them wait for their timeout one by one.
+func (c *SeederClient) keepalive() {
+	ticker := time.NewTicker(KEEPALIVE_INTERVAL / 2)
+	defer ticker.Stop()
+	var seq uint64
+	for range ticker.C {
+		if c.Err() != nil {
+			return
+		}
+		quiet := time.Since(time.Unix(0, atomic.LoadInt64(&c.mux.lastRecv)))
+		if quiet >= 2*KEEPALIVE_INTERVAL {
+			log.Printf("%s didn't answer for %v, closing the connection", c.conn.RemoteAddr(), quiet)
+			c.abort(ErrTimeout)
+			return
+		}
+		if quiet >= KEEPALIVE_INTERVAL {
+			seq++
+			// tag 0 is never used by a request, the PONG is dropped by
+			// readLoop after it counts as activity
+			if err := c.wire.SendTagged(0, swp.Ping{Seq: seq}); err != nil {
+				c.abort(err)
+				return
+			}
+		}
+	}
+}
+
+// abort stops a multiplexed connection because of err. The connection is
+// closed, which makes readLoop fail and end the pending exchanges with the
+// first error recorded.
+func (c *SeederClient) abort(err error) {
+	c.mux.mu.Lock()
+	if c.mux.err == nil {
+		c.mux.err = err
+	}
+	c.mux.mu.Unlock()
+	c.conn.Close()
+}
+
+// fail ends all the pending exchanges with err. Only readLoop calls it, since
+// it's the only one which sends on their channels; everyone else uses abort.
+func (c *SeederClient) fail(err error) {
+	c.mux.mu.Lock()
+	if c.mux.err == nil {
+		c.mux.err = err
+	}
+	for tag, x := range c.mux.pending {
+		delete(c.mux.pending, tag)
+		close(x.rsps)
+	}
+	c.mux.mu.Unlock()
+}
+
+// Err returns the error which stopped a multiplexed connection.
+func (c *SeederClient) Err() error {
+	if c.mux == nil {
+		return nil
+	}
+	c.mux.mu.Lock()
+	defer c.mux.mu.Unlock()
+	return c.mux.err
+}
+
+// Muxed returns true if many requests can be sent at the same time on the
+// connection.
+func (c *SeederClient) Muxed() bool {
+	return c.muxed
+}
+
+// Broken returns true if the connection can't be used anymore after one of
+// its requests failed with err.
+func (c *SeederClient) Broken(err error) bool {
+	if c.muxed {
+		return c.Err() != nil
+	}
+	var seederErr SeederError
+	return !errors.As(err, &seederErr) && !errors.Is(err, context.Canceled)
+}
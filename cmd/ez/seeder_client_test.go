@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aburdulescu/ez/cmn"
+	"github.com/aburdulescu/ez/swp"
+)
+
+// acceptHello answers the HELLO of the client on conn like a seeder with the
+// given capabilities, and returns the connection with the agreed framing or
+// nil if the handshake failed.
+func acceptHello(conn net.Conn, caps swp.Caps) *swp.Conn {
+	wire := swp.NewConn(conn)
+	msg, cleanup, err := wire.Recv()
+	if err != nil {
+		return nil
+	}
+	defer cleanup()
+	remote, ok := msg.(swp.Hello)
+	if !ok {
+		return nil
+	}
+	local := swp.NewHello("test", swp.DefaultMaxFrame)
+	local.Caps = caps
+	if err := wire.Send(local); err != nil {
+		return nil
+	}
+	proto, err := swp.Negotiate(local, remote)
+	if err != nil {
+		return nil
+	}
+	wire.SetFraming(swp.FramingFor(proto))
+	return wire
+}
+
+// TestSeederClientMux checks that concurrent requests on one connection get
+// their own responses when the seeder answers them out of order.
+func TestSeederClientMux(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	chunks := [][]byte{
+		bytes.Repeat([]byte{1}, 3*cmn.PieceSize),
+		bytes.Repeat([]byte{2}, 2*cmn.PieceSize+1),
+	}
+
+	go func() {
+		wire := acceptHello(sconn, swp.SupportedCaps)
+		if wire == nil {
+			return
+		}
+		tags := make(map[uint64]uint32)
+		for len(tags) != len(chunks) {
+			tag, msg, cleanup, err := wire.RecvTagged()
+			if err != nil {
+				return
+			}
+			tags[msg.(swp.Getchunk).Index] = tag
+			cleanup()
+		}
+		// interleave the pieces, starting with the last request
+		for off := 0; off < 3*cmn.PieceSize; off += cmn.PieceSize {
+			for i := len(chunks) - 1; i >= 0; i-- {
+				chunk := chunks[i]
+				if off == 0 {
+					npieces := uint64((len(chunk) + cmn.PieceSize - 1) / cmn.PieceSize)
+					wire.SendTagged(tags[uint64(i)], swp.Chunkinfo{NPieces: npieces})
+				}
+				if off >= len(chunk) {
+					continue
+				}
+				end := off + cmn.PieceSize
+				if end > len(chunk) {
+					end = len(chunk)
+				}
+				wire.SendTagged(tags[uint64(i)], swp.Piece{Piece: chunk[off:end]})
+			}
+		}
+	}()
+
+	c := &SeederClient{conn: cconn, wire: swp.NewConn(cconn)}
+	if err := c.hello(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Muxed() {
+		t.Fatal("connection is not multiplexed")
+	}
+
+	var wg sync.WaitGroup
+	for i := range chunks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make(ChunkBuffer, cmn.ChunkSize)
+			n, err := c.Getchunk(context.Background(), uint64(i), cmn.NewChecksum(chunks[i]), buf)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(buf[:n], chunks[i]) {
+				t.Errorf("chunk %d differs", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestSeederClientTimeout checks that a request which the seeder doesn't
+// answer fails with ErrTimeout and leaves the connection usable.
+func TestSeederClientTimeout(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	go func() {
+		wire := acceptHello(sconn, swp.SupportedCaps)
+		if wire == nil {
+			return
+		}
+		// never answer
+		for {
+			_, _, cleanup, err := wire.RecvTagged()
+			if err != nil {
+				return
+			}
+			cleanup()
+		}
+	}()
+
+	c := &SeederClient{conn: cconn, wire: swp.NewConn(cconn), timeout: 100 * time.Millisecond}
+	if err := c.hello(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make(ChunkBuffer, cmn.ChunkSize)
+	_, err := c.Getchunk(context.Background(), 0, 0, buf)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected %v, got %v", ErrTimeout, err)
+	}
+	if c.Broken(err) {
+		t.Fatal("connection broken by a timeout")
+	}
+}
+
+// cancelWriter cancels the download after the first piece.
+type cancelWriter struct {
+	cancel context.CancelFunc
+}
+
+func (w cancelWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.cancel()
+	return len(p), nil
+}
+
+// TestSeederClientCancel checks that a cancelled chunk is cancelled on the
+// seeder too and that the connection can be used after it.
+func TestSeederClientCancel(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	chunk := bytes.Repeat([]byte{3}, cmn.PieceSize)
+	cancelled := make(chan bool, 1)
+	go func() {
+		wire := acceptHello(sconn, swp.SupportedCaps)
+		if wire == nil {
+			return
+		}
+		var first uint32
+		for {
+			tag, msg, cleanup, err := wire.RecvTagged()
+			if err != nil {
+				return
+			}
+			cleanup()
+			switch msg.Type() {
+			case swp.GETCHUNK:
+				if msg.(swp.Getchunk).Index == 0 {
+					// the client has to cancel, not wait for 1000 pieces
+					first = tag
+					wire.SendTagged(tag, swp.Chunkinfo{NPieces: 1000})
+					wire.SendTagged(tag, swp.Piece{Piece: chunk})
+					continue
+				}
+				wire.SendTagged(tag, swp.Chunkinfo{NPieces: 1})
+				wire.SendTagged(tag, swp.Piece{Piece: chunk})
+			case swp.CANCEL:
+				cancelled <- tag == first
+				wire.SendTagged(tag, swp.Ack{})
+			}
+		}
+	}()
+
+	c := &SeederClient{conn: cconn, wire: swp.NewConn(cconn), timeout: 5 * time.Second}
+	if err := c.hello(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := c.Getchunk(ctx, 0, 0, cancelWriter{cancel})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if !<-cancelled {
+		t.Fatal("CANCEL sent for another request")
+	}
+	if c.Broken(err) {
+		t.Fatal("connection broken by a cancel")
+	}
+	buf := make(ChunkBuffer, cmn.ChunkSize)
+	n, err := c.Getchunk(context.Background(), 1, cmn.NewChecksum(chunk), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], chunk) {
+		t.Fatal("chunk differs")
+	}
+}
+
+// TestSeederClientGetchecksums checks that a peer can't make the client keep
+// more checksums than the file has chunks.
+func TestSeederClientGetchecksums(t *testing.T) {
+	tests := []struct {
+		name string
+		rsps []swp.Checksums
+		ok   bool
+	}{
+		{"Valid", []swp.Checksums{{Total: 3, Checksums: []uint64{1, 2}}, {Total: 3, Checksums: []uint64{3}}}, true},
+		{"WrongTotal", []swp.Checksums{{Total: 1 << 40, Checksums: []uint64{1}}}, false},
+		{"TooMany", []swp.Checksums{{Total: 3, Checksums: []uint64{1, 2, 3, 4}}}, false},
+		{"TooManyLater", []swp.Checksums{{Total: 3, Checksums: []uint64{1, 2}}, {Total: 3, Checksums: []uint64{3, 4}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cconn, sconn := net.Pipe()
+			defer cconn.Close()
+			defer sconn.Close()
+
+			go func() {
+				wire := acceptHello(sconn, swp.SupportedCaps)
+				if wire == nil {
+					return
+				}
+				for _, rsp := range tt.rsps {
+					tag, _, cleanup, err := wire.RecvTagged()
+					if err != nil {
+						return
+					}
+					cleanup()
+					if err := wire.SendTagged(tag, rsp); err != nil {
+						return
+					}
+				}
+			}()
+
+			c := &SeederClient{conn: cconn, wire: swp.NewConn(cconn), timeout: time.Second}
+			if err := c.hello(); err != nil {
+				t.Fatal(err)
+			}
+			checksums, err := c.Getchecksums(3)
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(checksums) != 3 {
+					t.Fatalf("expected 3 checksums, got %d", len(checksums))
+				}
+			} else if err == nil {
+				t.Fatalf("expected an error, got %d checksums", len(checksums))
+			}
+		})
+	}
+}
+
+// TestSeederClientAbort checks that a connection can be stopped while
+// readLoop is blocked delivering a response, and that the pending requests
+// get the error which stopped it.
+func TestSeederClientAbort(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	go func() {
+		wire := acceptHello(sconn, swp.SupportedCaps)
+		if wire == nil {
+			return
+		}
+		tag, _, cleanup, err := wire.RecvTagged()
+		if err != nil {
+			return
+		}
+		cleanup()
+		// more pieces than the client queues
+		piece := bytes.Repeat([]byte{4}, cmn.PieceSize)
+		wire.SendTagged(tag, swp.Chunkinfo{NPieces: 4 * MUX_QUEUE})
+		for i := 0; i < 4*MUX_QUEUE; i++ {
+			if err := wire.SendTagged(tag, swp.Piece{Piece: piece}); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := &SeederClient{conn: cconn, wire: swp.NewConn(cconn), timeout: 5 * time.Second}
+	if err := c.hello(); err != nil {
+		t.Fatal(err)
+	}
+	x, err := c.request(swp.Getchunk{Index: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.done()
+	for len(x.rsps) < MUX_QUEUE {
+		time.Sleep(time.Millisecond)
+	}
+	// readLoop has the next piece and waits for room in the queue
+	time.Sleep(10 * time.Millisecond)
+
+	errAbort := errors.New("aborted")
+	go c.abort(errAbort)
+	for {
+		_, cleanup, err := x.recv(context.Background())
+		if err != nil {
+			if !errors.Is(err, errAbort) {
+				t.Fatalf("expected %v, got %v", errAbort, err)
+			}
+			break
+		}
+		cleanup()
+	}
+	if _, err := c.request(swp.Getchunk{Index: 1}); !errors.Is(err, errAbort) {
+		t.Fatalf("expected %v for a new request, got %v", errAbort, err)
+	}
+}
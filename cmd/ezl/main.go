@@ -2,10 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/aburdulescu/ez/cadet"
 	"github.com/aburdulescu/ez/cmn"
@@ -25,7 +29,7 @@ var commands = []*cadet.Command{
 		Run:   onLs,
 	},
 	&cadet.Command{
-		Use:   "add",
+		Use:   "add [-tag t]... [-desc s] path",
 		Short: "Add a file",
 		Run:   onAdd,
 	},
@@ -65,18 +69,32 @@ func onLs(args []string) error {
 	}
 	p := cmn.NewPrinter()
 	defer p.Flush()
-	p.Printf("ID\tPath\tSize\n")
+	p.Printf("ID\tPath\tSize\tTags\n")
 	for _, f := range files {
-		p.Printf("%s\t%s\t%d\n", f.Id, filepath.Join(f.IFile.Dir, f.IFile.Name), f.IFile.Size)
+		var tags []string
+		if f.IFile.Meta != nil {
+			tags = f.IFile.Meta.Tags
+		}
+		p.Printf("%s\t%s\t%d\t%s\n", f.Id, filepath.Join(f.IFile.Dir, f.IFile.Name), f.IFile.Size, strings.Join(tags, ","))
 	}
 	return nil
 }
 
 func onAdd(args []string) error {
-	if len(args) < 1 {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	var tags cmn.Strings
+	fs.Var(&tags, "tag", "tag of the file, can be repeated or hold more tags separated by commas")
+	desc := fs.String("desc", "", "description of the file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
 		return fmt.Errorf("filepath wasn't provided")
 	}
-	path := args[0]
+	if _, err := ezt.NormalizeTags(tags); err != nil {
+		return err
+	}
+	path := fs.Arg(0)
 	if !filepath.IsAbs(path) {
 		pwd, err := os.Getwd()
 		if err != nil {
@@ -84,11 +102,19 @@ func onAdd(args []string) error {
 		}
 		path = filepath.Join(pwd, path)
 	}
-	rsp, err := http.Get("http://localhost:22202/add?path=" + path)
+	query := url.Values{"path": {path}, "tag": tags}
+	if *desc != "" {
+		query.Set("desc", *desc)
+	}
+	rsp, err := http.Get("http://localhost:22202/add?" + query.Encode())
 	if err != nil {
 		return err
 	}
 	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(rsp.Body)
+		return fmt.Errorf("%s", strings.TrimSpace(string(b)))
+	}
 	return nil
 }
 
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// corker keeps the connection corked while pieces are sent from files, by
+// any of the requests served on it.
+type corker struct {
+	mu    sync.Mutex
+	conn  net.Conn
+	users int
+}
+
+func (c *corker) hold() {
+	c.mu.Lock()
+	c.users++
+	if c.users == 1 {
+		setCork(c.conn, true)
+	}
+	c.mu.Unlock()
+}
+
+func (c *corker) release() {
+	c.mu.Lock()
+	c.users--
+	if c.users == 0 {
+		setCork(c.conn, false)
+	}
+	c.mu.Unlock()
+}
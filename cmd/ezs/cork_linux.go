@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setCork holds back the partial TCP segments while on is set, so that the
+// header of a frame written before a sendfile goes out in the same segment
+// as the start of the piece.
+func setCork(conn net.Conn, on bool) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return
+	}
+	v := 0
+	if on {
+		v = 1
+	}
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CORK, v)
+	})
+}
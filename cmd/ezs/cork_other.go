@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+func setCork(conn net.Conn, on bool) {}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/aburdulescu/ez/ezt"
+	"github.com/aburdulescu/ez/swp"
+)
+
+// MAX_OPEN_FILES is how many files a client can have open at the same time
+// on one connection, besides the one opened with CONNECT.
+const MAX_OPEN_FILES = 64
+
+type openFile struct {
+	id    string
+	path  string
+	f     *os.File
+	ifile ezt.IFile
+	// users counts the requests being served from the file, which must
+	// finish before it's closed
+	users sync.WaitGroup
+}
+
+// close waits for the requests which use the file and closes it.
+func (of *openFile) close() {
+	of.users.Wait()
+	of.f.Close()
+}
+
+// fileTable holds the files opened on a connection, by handle. Handle 0 is
+// the file opened with CONNECT.
+type fileTable struct {
+	mu    sync.Mutex
+	files map[swp.Handle]*openFile
+	next  swp.Handle
+}
+
+func newFileTable() *fileTable {
+	return &fileTable{files: make(map[swp.Handle]*openFile)}
+}
+
+// add stores of under a new handle.
+func (t *fileTable) add(of *openFile) (swp.Handle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.files)
+	if _, ok := t.files[0]; ok {
+		n--
+	}
+	if n >= MAX_OPEN_FILES {
+		return 0, fmt.Errorf("too many open files")
+	}
+	for {
+		t.next++
+		if t.next == 0 {
+			continue
+		}
+		if _, ok := t.files[t.next]; !ok {
+			break
+		}
+	}
+	t.files[t.next] = of
+	return t.next, nil
+}
+
+// set stores of under handle and returns the file which was there before, if
+// any.
+func (t *fileTable) set(handle swp.Handle, of *openFile) *openFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.files[handle]
+	t.files[handle] = of
+	return old
+}
+
+// remove removes the file with the given handle from the table and returns
+// it, or nil if there is no such file.
+func (t *fileTable) remove(handle swp.Handle) *openFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	of := t.files[handle]
+	delete(t.files, handle)
+	return of
+}
+
+// acquire returns the file with the given handle, or nil if there is no such
+// file. The file stays open until release is called.
+func (t *fileTable) acquire(handle swp.Handle) *openFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	of := t.files[handle]
+	if of != nil {
+		of.users.Add(1)
+	}
+	return of
+}
+
+func (t *fileTable) release(of *openFile) {
+	of.users.Done()
+}
+
+// closeAll closes all the files, when the connection ends.
+func (t *fileTable) closeAll() {
+	t.mu.Lock()
+	files := t.files
+	t.files = make(map[swp.Handle]*openFile)
+	t.mu.Unlock()
+	for _, of := range files {
+		of.close()
+	}
+}
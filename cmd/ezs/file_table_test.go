@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/aburdulescu/ez/swp"
+)
+
+func TestFileTable(t *testing.T) {
+	files := newFileTable()
+	files.set(0, &openFile{})
+	add := func() swp.Handle {
+		t.Helper()
+		handle, err := files.add(&openFile{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handle
+	}
+	if handle := add(); handle != 1 {
+		t.Fatal("expected handle 1, got", handle)
+	}
+	// the handles wrap around without giving 0 or one which is taken
+	files.next = math.MaxUint32 - 1
+	if handle := add(); handle != math.MaxUint32 {
+		t.Fatal("expected the last handle, got", handle)
+	}
+	if handle := add(); handle != 2 {
+		t.Fatal("expected handle 2, got", handle)
+	}
+	if files.remove(1) == nil || files.remove(1) != nil {
+		t.Fatal("handle 1 was not removed once")
+	}
+
+	// the file opened with CONNECT doesn't count toward the limit
+	for i := 2; i < MAX_OPEN_FILES; i++ {
+		add()
+	}
+	if _, err := files.add(&openFile{}); err == nil {
+		t.Fatalf("more than %d files were opened", MAX_OPEN_FILES)
+	}
+	files.remove(2)
+	add()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"path/filepath"
 
+	"github.com/aburdulescu/ez/ezt"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -97,6 +98,11 @@ func (w Watcher) Run() {
 					logger.Printf("%s not found", event.Name)
 					continue
 				}
+				// the tags and description stay with the new content
+				var meta ezt.Metadata
+				if ifile, err := w.db.GetIFile(id); err == nil && ifile.Meta != nil {
+					meta = *ifile.Meta
+				}
 				if err := RemoveFile(w.db, id); err != nil {
 					logger.Println(err)
 					continue
@@ -105,7 +111,7 @@ func (w Watcher) Run() {
 					logger.Println(err)
 					continue
 				}
-				id, err := AddFile(w.db, event.Name)
+				id, err := AddFile(w.db, event.Name, meta)
 				if err != nil {
 					logger.Println(err)
 					continue
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aburdulescu/ez/ezt"
+)
+
+const HEARTBEAT_INTERVAL = 30 * time.Second
+
+// sendHeartbeats renews the lease of the seeder at the tracker and registers
+// all files again when the tracker doesn't know the seeder, e.g. after it was
+// restarted or expired the seeder. The first heartbeat is sent right away,
+// the next ones HEARTBEAT_INTERVAL apart until the tracker answers with the
+// length of the lease, and a third of the lease apart after that.
+func sendHeartbeats(db *DB) {
+	trackerClient := ezt.NewClient(trackerURL)
+	interval := HEARTBEAT_INTERVAL
+	for ; ; time.Sleep(interval) {
+		rsp, err := trackerClient.Heartbeat(ezt.HeartbeatRequest{Addr: seedAddr})
+		if errors.Is(err, ezt.ErrUnknownPeer) {
+			logger.Println("tracker doesn't know the seeder, registering again")
+			if err := updateTracker(db); err != nil {
+				logger.Println(err)
+			}
+			continue
+		}
+		if err != nil {
+			logger.Println(err)
+			continue
+		}
+		interval = HEARTBEAT_INTERVAL
+		if rsp.Lease != 0 {
+			interval = time.Duration(rsp.Lease) * time.Second / 3
+		}
+	}
+}
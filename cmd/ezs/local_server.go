@@ -7,6 +7,8 @@ import (
 	"io"
 	"log"
 	"net/http"
+
+	"github.com/aburdulescu/ez/ezt"
 )
 
 type LocalServer struct {
@@ -61,7 +63,14 @@ func (s LocalServer) handleAdd(w http.ResponseWriter, r *http.Request) (int, err
 	if path == "" {
 		return http.StatusBadRequest, errors.New("missing 'path' parameter")
 	}
-	id, err := AddFile(s.db, path)
+	meta := ezt.Metadata{
+		Tags: r.URL.Query()["tag"],
+		Desc: r.URL.Query().Get("desc"),
+	}
+	if _, err := ezt.NormalizeTags(meta.Tags); err != nil {
+		return http.StatusBadRequest, err
+	}
+	id, err := AddFile(s.db, path, meta)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
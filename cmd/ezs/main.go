@@ -8,6 +8,9 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	"github.com/aburdulescu/ez/cmn"
 )
 
 func main() {
@@ -21,6 +24,9 @@ var dbPath string
 var seedAddr string
 var trackerAddr string
 var disableLog bool
+var maxPieceSize int
+var idleTimeout time.Duration
+var writeTimeout time.Duration
 
 var trackerURL string
 var logger Logger
@@ -30,6 +36,9 @@ func run() error {
 	flag.StringVar(&seedAddr, "seedaddr", "", "address to be used by peers")
 	flag.StringVar(&trackerAddr, "trackeraddr", "", "tracker address")
 	flag.BoolVar(&disableLog, "disable-log", false, "disable logging")
+	flag.IntVar(&maxPieceSize, "piecesize", 256<<10, "size of the pieces sent to clients which support wide frames")
+	flag.DurationVar(&idleTimeout, "idle", 2*time.Minute, "close the connections of clients which don't send anything for this long, 0 to keep them")
+	flag.DurationVar(&writeTimeout, "write-timeout", 30*time.Second, "close the connections of clients which don't read what's sent to them for this long, 0 to wait forever")
 	flag.Parse()
 
 	if seedAddr == "" {
@@ -38,6 +47,12 @@ func run() error {
 	if trackerAddr == "" {
 		return fmt.Errorf("trackeraddr is empty")
 	}
+	if maxPieceSize < cmn.PieceSize || maxPieceSize > cmn.ChunkSize {
+		return fmt.Errorf("piecesize must be between %d and %d", cmn.PieceSize, cmn.ChunkSize)
+	}
+	if idleTimeout < 0 || writeTimeout < 0 {
+		return fmt.Errorf("timeouts can't be negative")
+	}
 
 	if disableLog {
 		logger = &NopLogger{
@@ -75,7 +90,9 @@ func run() error {
 	}
 	go trackerProbeServer.ListenAndServe()
 
-	c := make(chan os.Signal)
+	go sendHeartbeats(db)
+
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	waitForSignal(c, db)
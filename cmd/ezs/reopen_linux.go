@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// reopen opens the file of of again, with its own offset. The descriptor
+// opened by CONNECT or OPEN is opened again through /proc, which gives the
+// same file even if it was renamed, deleted or replaced since.
+func reopen(of *openFile) (*os.File, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/self/fd/%d", of.f.Fd()))
+	if err != nil {
+		// /proc is not mounted
+		return os.Open(of.path)
+	}
+	return f, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// reopen opens the file of of again, with its own offset.
+func reopen(of *openFile) (*os.File, error) {
+	return os.Open(of.path)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// requestTable holds the requests being served on a connection, by id, so
+// that they can be cancelled.
+type requestTable struct {
+	mu   sync.Mutex
+	reqs map[uint32]*request
+}
+
+type request struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+func newRequestTable() *requestTable {
+	return &requestTable{reqs: make(map[uint32]*request)}
+}
+
+// start registers the request with the given id and returns the context
+// which is done when it's cancelled. It returns false if a request with the
+// same id is still being served.
+func (t *requestTable) start(tag uint32) (context.Context, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reqs[tag] != nil {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.reqs[tag] = &request{ctx: ctx, cancel: cancel}
+	return ctx, true
+}
+
+// done unregisters the request and returns true if it was cancelled, in
+// which case the caller acknowledges the CANCEL.
+func (t *requestTable) done(tag uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	req := t.reqs[tag]
+	if req == nil {
+		return false
+	}
+	delete(t.reqs, tag)
+	req.cancel()
+	return req.cancelled
+}
+
+// cancel cancels the request and returns false if it's not being served, in
+// which case the caller acknowledges the CANCEL.
+func (t *requestTable) cancel(tag uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	req := t.reqs[tag]
+	if req == nil {
+		return false
+	}
+	req.cancelled = true
+	req.cancel()
+	return true
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestRequestTable(t *testing.T) {
+	requests := newRequestTable()
+	ctx, ok := requests.start(1)
+	if !ok {
+		t.Fatal("first request was refused")
+	}
+	if _, ok := requests.start(1); ok {
+		t.Fatal("request with the id of one in flight was accepted")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("duplicate request cancelled the first one")
+	}
+	if !requests.cancel(1) || !requests.done(1) {
+		t.Fatal("expected the request to be cancelled")
+	}
+	if ctx.Err() == nil {
+		t.Fatal("context of the cancelled request is not done")
+	}
+	if _, ok := requests.start(1); !ok {
+		t.Fatal("id was not freed when the request was done")
+	}
+}
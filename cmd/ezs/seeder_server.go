@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/aburdulescu/ez/cmn"
-	"github.com/aburdulescu/ez/ezt"
 	"github.com/aburdulescu/ez/swp"
 )
 
@@ -18,17 +21,29 @@ var chunkPool = sync.Pool{
 	},
 }
 
+var errNotConnected = errors.New("CONNECT wasn't sent")
+
+// MAX_CONN_REQUESTS is how many requests of a client are served at the same
+// time, when the client tags its requests.
+const MAX_CONN_REQUESTS = 16
+
+// MAX_CONNS is how many clients are served at the same time, the others get
+// a busy error.
+const MAX_CONNS = 256
+
 type SeederServer struct {
-	ln net.Listener
-	db *DB
+	ln    net.Listener
+	db    *DB
+	conns chan struct{}
 }
 
 type SeederServerReqHandler struct {
-	id    string
 	conn  net.Conn
+	wire  *swp.Conn
 	db    *DB
-	f     *os.File
-	ifile *ezt.IFile
+	files *fileTable
+	proto swp.Hello
+	cork  *corker
 }
 
 func NewSeederServer(db *DB) (SeederServer, error) {
@@ -38,6 +53,7 @@ func NewSeederServer(db *DB) (SeederServer, error) {
 	}
 	s := SeederServer{
 		ln: ln, db: db,
+		conns: make(chan struct{}, MAX_CONNS),
 	}
 	return s, nil
 }
@@ -50,123 +66,453 @@ func (s SeederServer) ListenAndServe() {
 			continue
 		}
 		h := SeederServerReqHandler{
-			db:   s.db,
-			conn: conn,
+			db:    s.db,
+			conn:  conn,
+			wire:  swp.NewConn(conn),
+			files: newFileTable(),
+			proto: swp.Legacy(),
+			cork:  &corker{conn: conn},
+		}
+		h.wire.SetWriteTimeout(writeTimeout)
+		select {
+		case s.conns <- struct{}{}:
+			go func() {
+				h.run()
+				<-s.conns
+			}()
+		default:
+			err := h.sendError(0, swp.ERR_BUSY, fmt.Errorf("too many clients"))
+			logger.Printf("%s: error: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
 		}
-		go h.run()
 	}
 }
 
 func (h SeederServerReqHandler) run() {
 	defer h.conn.Close()
+	defer h.files.closeAll()
 	remAddr := h.conn.RemoteAddr().String()
+	// with tagged frames, chunk and checksum requests are served
+	// concurrently; requests which change the state of the connection wait
+	// for them to finish first
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+	// busy counts the requests being served, while a client waits for
+	// their answers it doesn't have to send anything, so the connection
+	// has no read deadline. A read which times out is then always idle,
+	// even if it stopped in the middle of a frame.
+	var busyMu sync.Mutex
+	busy := 0
+	setBusy := func(delta int) {
+		busyMu.Lock()
+		defer busyMu.Unlock()
+		busy += delta
+		if idleTimeout <= 0 {
+			return
+		}
+		if busy == 0 {
+			h.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		} else {
+			h.conn.SetReadDeadline(time.Time{})
+		}
+	}
+	sem := make(chan struct{}, MAX_CONN_REQUESTS)
+	report := func(err error) {
+		logger.Printf("%s: error: %v\n", remAddr, err)
+		// a send which timed out or failed in the middle of a frame
+		// may have written part of it, the client can't be answered
+		// anymore
+		var netErr net.Error
+		if errors.Is(err, swp.ErrBrokenFrame) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			h.conn.Close()
+		}
+	}
+	requests := newRequestTable()
+	serve := func(tag uint32, f func(ctx context.Context) error) {
+		if !h.wire.Framing().Tagged {
+			if err := f(context.Background()); err != nil {
+				report(err)
+			}
+			return
+		}
+		ctx, ok := requests.start(tag)
+		if !ok {
+			report(h.sendError(tag, swp.ERR_BAD_REQUEST, fmt.Errorf("request %d is already being served", tag)))
+			return
+		}
+		sem <- struct{}{}
+		inflight.Add(1)
+		setBusy(1)
+		go func() {
+			defer inflight.Done()
+			if err := f(ctx); err != nil {
+				report(err)
+			}
+			if requests.done(tag) {
+				if err := h.wire.SendTagged(tag, swp.Ack{}); err != nil {
+					report(err)
+				}
+			}
+			setBusy(-1)
+			<-sem
+		}()
+	}
 	for {
-		msg, cleanup, err := swp.Recv(h.conn)
+		// every message received starts the idle time again
+		setBusy(0)
+		tag, msg, cleanup, err := h.wire.RecvTagged()
 		if err == io.EOF {
 			return
 		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			logger.Printf("%s: idle for %v, closing the connection\n", remAddr, idleTimeout)
+			return
+		}
 		if err != nil {
+			// a client which sends garbage is not given another chance,
+			// but it's told why
 			logger.Printf("%s: error: %v\n", remAddr, err)
-			continue
+			if swp.IsDecodeError(err) {
+				h.sendError(tag, swp.ERR_BAD_REQUEST, err)
+			}
+			return
 		}
 		msgType := msg.Type()
 		switch msgType {
+		case swp.CANCEL:
+			logger.Printf("%s: CANCEL %v\n", remAddr, tag)
+			if !requests.cancel(tag) {
+				if err := h.wire.SendTagged(tag, swp.Ack{}); err != nil {
+					report(err)
+				}
+			}
+		case swp.PING:
+			req := msg.(swp.Ping)
+			if err := h.wire.SendTagged(tag, swp.Pong{Seq: req.Seq}); err != nil {
+				logger.Printf("%s: error: %v\n", remAddr, err)
+			}
+		case swp.HELLO:
+			req := msg.(swp.Hello)
+			logger.Printf("%s: HELLO %v %v %v\n", remAddr, req.Impl, req.Version, req.Caps)
+			inflight.Wait()
+			if err := h.handleHello(req); err != nil {
+				logger.Printf("%s: error: %v\n", remAddr, err)
+				cleanup()
+				return
+			}
 		case swp.CONNECT:
 			req := msg.(swp.Connect)
 			logger.Printf("%s: CONNECT %v\n", remAddr, req.Id)
-			if err := h.handleConnect(req.Id); err != nil {
+			inflight.Wait()
+			if err := h.handleConnect(tag, req.Id); err != nil {
 				logger.Printf("%s: error: %v\n", remAddr, err)
 			}
 		case swp.DISCONNECT:
 			logger.Printf("%s: DISCONNECT\n", remAddr)
-			if err := h.handleDisconnect(); err != nil {
+			inflight.Wait()
+			if err := h.handleDisconnect(tag); err != nil {
 				logger.Printf("%s: error: %v\n", remAddr, err)
 			}
+		case swp.OPEN:
+			req := msg.(swp.Open)
+			logger.Printf("%s: OPEN %v\n", remAddr, req.Id)
+			serve(tag, func(context.Context) error { return h.handleOpen(tag, req.Id) })
+		case swp.CLOSE:
+			req := msg.(swp.Close)
+			logger.Printf("%s: CLOSE %v\n", remAddr, req.Handle)
+			serve(tag, func(context.Context) error { return h.handleClose(tag, req.Handle) })
 		case swp.GETCHUNK:
 			req := msg.(swp.Getchunk)
-			logger.Printf("%s: GETCHUNK %v\n", remAddr, req.Index)
-			if err := h.handleGetchunk(req.Index); err != nil {
-				logger.Printf("%s: error: %v\n", remAddr, err)
-			}
+			logger.Printf("%s: GETCHUNK %v %v\n", remAddr, req.Handle, req.Index)
+			serve(tag, func(ctx context.Context) error { return h.handleGetchunk(ctx, tag, req.Handle, req.Index) })
+		case swp.GETRANGE:
+			req := msg.(swp.Getrange)
+			logger.Printf("%s: GETRANGE %v %v %v\n", remAddr, req.Handle, req.Offset, req.Length)
+			serve(tag, func(ctx context.Context) error {
+				return h.handleGetrange(ctx, tag, req.Handle, req.Offset, req.Length)
+			})
+		case swp.GETCHECKSUMS:
+			req := msg.(swp.Getchecksums)
+			logger.Printf("%s: GETCHECKSUMS %v %v\n", remAddr, req.Handle, req.Start)
+			serve(tag, func(context.Context) error { return h.handleGetchecksums(tag, req.Handle, req.Start) })
 		default:
-			logger.Printf("%s: error: unknown request type %v\n", remAddr, msgType)
+			err := h.sendError(tag, swp.ERR_BAD_REQUEST, fmt.Errorf("unknown request type %v", msgType))
+			logger.Printf("%s: error: %v\n", remAddr, err)
+			cleanup()
+			return
 		}
 		cleanup()
 	}
 }
 
-func (h *SeederServerReqHandler) handleConnect(id string) error {
-	h.id = id
-	ifile, err := h.db.GetIFile(h.id)
-	if err != nil {
+// handleHello answers with what this seeder supports. If the client is too
+// old, the answer still goes out, so that the client can report the
+// mismatch, and the connection is closed.
+func (h *SeederServerReqHandler) handleHello(req swp.Hello) error {
+	local := swp.NewHello("ezs", maxPieceSize+swp.Piece{}.Size()+swp.TagSize)
+	if err := h.wire.Send(local); err != nil {
 		logger.Println(err)
 		return err
 	}
-	h.ifile = &ifile
-	f, err := os.Open(filepath.Join(ifile.Dir, ifile.Name))
+	proto, err := swp.Negotiate(local, req)
 	if err != nil {
-		logger.Println(err)
 		return err
 	}
-	h.f = f
-	if err := swp.Send(h.conn, swp.Ack{}); err != nil {
+	h.proto = proto
+	h.wire.SetFraming(swp.FramingFor(proto))
+	return nil
+}
+
+// pieceSize returns the size of the pieces which fit in the frames used on
+// the connection.
+func (h SeederServerReqHandler) pieceSize() int {
+	if !h.proto.Caps.Has(swp.CapWideFrames) {
+		return cmn.PieceSize
+	}
+	framing := h.wire.Framing()
+	size := framing.MaxFrame - framing.Overhead() - swp.Piece{}.Size()
+	if size > maxPieceSize {
+		size = maxPieceSize
+	}
+	return size
+}
+
+func (h SeederServerReqHandler) handleConnect(tag uint32, id string) error {
+	of, err := h.open(tag, id)
+	if err != nil {
+		return err
+	}
+	if old := h.files.set(0, of); old != nil {
+		old.close()
+	}
+	if err := h.wire.SendTagged(tag, swp.Ack{}); err != nil {
 		logger.Println(err)
 		return err
 	}
 	return nil
 }
 
-func (h *SeederServerReqHandler) handleDisconnect() error {
-	h.id = ""
-	h.ifile = nil
-	h.f.Close()
-	h.f = nil
-	if err := swp.Send(h.conn, swp.Ack{}); err != nil {
+func (h SeederServerReqHandler) handleDisconnect(tag uint32) error {
+	of := h.files.remove(0)
+	if of == nil {
+		return h.sendError(tag, swp.ERR_NOT_CONNECTED, errNotConnected)
+	}
+	of.close()
+	if err := h.wire.SendTagged(tag, swp.Ack{}); err != nil {
 		logger.Println(err)
 		return err
 	}
 	return nil
 }
 
-func (h SeederServerReqHandler) handleGetchunk(index uint64) error {
-	checksums, err := h.db.GetChecksums(h.id)
+// handleOpen opens another file on the connection, next to the one opened
+// with CONNECT.
+func (h SeederServerReqHandler) handleOpen(tag uint32, id string) error {
+	of, err := h.open(tag, id)
+	if err != nil {
+		return err
+	}
+	handle, err := h.files.add(of)
 	if err != nil {
+		of.close()
+		return h.sendError(tag, swp.ERR_BUSY, err)
+	}
+	if err := h.wire.SendTagged(tag, swp.Opened{Handle: handle}); err != nil {
+		logger.Println(err)
+		return err
+	}
+	return nil
+}
+
+// handleClose closes a file opened with OPEN, after the requests being served
+// from it are done.
+func (h SeederServerReqHandler) handleClose(tag uint32, handle swp.Handle) error {
+	if handle == 0 {
+		return h.sendError(tag, swp.ERR_BAD_REQUEST, fmt.Errorf("handle 0 is closed with DISCONNECT"))
+	}
+	of := h.files.remove(handle)
+	if of == nil {
+		return h.sendError(tag, swp.ERR_NOT_CONNECTED, fmt.Errorf("unknown handle %d", handle))
+	}
+	of.close()
+	if err := h.wire.SendTagged(tag, swp.Ack{}); err != nil {
 		logger.Println(err)
 		return err
 	}
-	chunkBuf, n, err := readChunk(h.f, index)
+	return nil
+}
+
+// open opens the file with the given id, or sends the error which prevents
+// it.
+func (h SeederServerReqHandler) open(tag uint32, id string) (*openFile, error) {
+	ifile, err := h.db.GetIFile(id)
+	if err != nil {
+		logger.Println(err)
+		return nil, h.sendError(tag, swp.ERR_UNKNOWN_ID, fmt.Errorf("unknown id '%s'", id))
+	}
+	path := filepath.Join(ifile.Dir, ifile.Name)
+	f, err := os.Open(path)
 	if err != nil {
 		logger.Println(err)
+		return nil, h.sendError(tag, swp.ERR_IO, err)
+	}
+	return &openFile{id: id, path: path, f: f, ifile: ifile}, nil
+}
+
+// acquire returns the file with the given handle, which must be released
+// after the request is served, or sends the error if there is no such file.
+func (h SeederServerReqHandler) acquire(tag uint32, handle swp.Handle) (*openFile, error) {
+	of := h.files.acquire(handle)
+	if of != nil {
+		return of, nil
+	}
+	if handle == 0 {
+		return nil, h.sendError(tag, swp.ERR_NOT_CONNECTED, errNotConnected)
+	}
+	return nil, h.sendError(tag, swp.ERR_NOT_CONNECTED, fmt.Errorf("unknown handle %d", handle))
+}
+
+func (h SeederServerReqHandler) handleGetchunk(ctx context.Context, tag uint32, handle swp.Handle, index uint64) error {
+	of, err := h.acquire(tag, handle)
+	if err != nil {
 		return err
 	}
-	defer chunkPool.Put(chunkBuf)
-	chunk := chunkBuf[:n]
-	npieces := uint64(len(chunk) / cmn.PieceSize)
-	remainder := uint64(0)
-	if len(chunk)%cmn.PieceSize != 0 {
+	defer h.files.release(of)
+	checksums, err := h.db.GetChecksums(of.id)
+	if err != nil {
+		logger.Println(err)
+		return h.sendError(tag, swp.ERR_UNKNOWN_ID, err)
+	}
+	if index >= uint64(len(checksums)) {
+		return h.sendError(tag, swp.ERR_OUT_OF_RANGE, fmt.Errorf("chunk %d out of %d", index, len(checksums)))
+	}
+	off := int64(index) * cmn.ChunkSize
+	n := of.ifile.Size - off
+	if n > cmn.ChunkSize {
+		n = cmn.ChunkSize
+	}
+	return h.sendChunk(ctx, tag, of, off, n, checksums[index])
+}
+
+// sendChunk sends n bytes of the file, starting at off, as a CHUNKINFO
+// followed by pieces which go from the file to the socket without being
+// copied in memory. The file is opened again, so that every chunk being sent
+// has its own file offset, and it must still be the file opened by CONNECT
+// or OPEN.
+func (h SeederServerReqHandler) sendChunk(ctx context.Context, tag uint32, of *openFile, off, n int64, checksum cmn.Checksum) error {
+	f, err := reopen(of)
+	if err != nil {
+		logger.Println(err)
+		return h.sendError(tag, swp.ERR_IO, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		logger.Println(err)
+		return h.sendError(tag, swp.ERR_IO, err)
+	}
+	ofi, err := of.f.Stat()
+	if err != nil {
+		logger.Println(err)
+		return h.sendError(tag, swp.ERR_IO, err)
+	}
+	if !os.SameFile(fi, ofi) {
+		return h.sendError(tag, swp.ERR_IO, fmt.Errorf("%s was replaced since it was opened", of.path))
+	}
+	if fi.Size() < off+n {
+		return h.sendError(tag, swp.ERR_IO, fmt.Errorf("%s is shorter than when it was shared", of.path))
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		logger.Println(err)
+		return h.sendError(tag, swp.ERR_IO, err)
+	}
+	pieceSize := int64(h.pieceSize())
+	npieces := uint64(n / pieceSize)
+	if n%pieceSize != 0 {
 		npieces++
-		remainder = 1
 	}
 	rsp := swp.Chunkinfo{
 		NPieces:  npieces,
-		Checksum: uint64(checksums[index]),
+		Checksum: uint64(checksum),
 	}
-	if err := swp.Send(h.conn, rsp); err != nil {
+	if err := h.wire.SendTagged(tag, rsp); err != nil {
 		logger.Println(err)
 		return err
 	}
-	i := uint64(0)
-	for ; i < npieces-remainder; i++ {
-		piece := chunk[i*cmn.PieceSize : (i+1)*cmn.PieceSize]
-		if err := swp.Send(h.conn, swp.Piece{piece}); err != nil {
+	h.cork.hold()
+	defer h.cork.release()
+	for sent := int64(0); sent < n; sent += pieceSize {
+		if ctx.Err() != nil {
+			return nil
+		}
+		size := pieceSize
+		if size > n-sent {
+			size = n - sent
+		}
+		if err := h.wire.SendPieceFrom(tag, f, int(size)); err != nil {
 			logger.Println(err)
 			return err
 		}
 	}
-	if remainder != 0 {
-		logger.Println(i * cmn.PieceSize)
-		piece := chunk[i*cmn.PieceSize:]
-		if err := swp.Send(h.conn, swp.Piece{piece}); err != nil {
+	return nil
+}
+
+func (h SeederServerReqHandler) handleGetrange(ctx context.Context, tag uint32, handle swp.Handle, offset, length uint64) error {
+	of, err := h.acquire(tag, handle)
+	if err != nil {
+		return err
+	}
+	defer h.files.release(of)
+	size := uint64(of.ifile.Size)
+	if length == 0 || length > cmn.ChunkSize {
+		return h.sendError(tag, swp.ERR_BAD_REQUEST, fmt.Errorf("range length must be between 1 and %d", cmn.ChunkSize))
+	}
+	if offset > size {
+		return h.sendError(tag, swp.ERR_OUT_OF_RANGE, fmt.Errorf("offset %d is past the end of the file", offset))
+	}
+	if length > size-offset {
+		length = size - offset
+	}
+	buf := chunkPool.Get().([]byte)
+	defer chunkPool.Put(buf)
+	data := buf[:length]
+	n, err := of.f.ReadAt(data, int64(offset))
+	if err != nil && err != io.EOF {
+		logger.Println(err)
+		return h.sendError(tag, swp.ERR_IO, err)
+	}
+	if n != len(data) {
+		return h.sendError(tag, swp.ERR_IO, fmt.Errorf("%s is shorter than when it was shared", of.path))
+	}
+	return h.sendPieces(ctx, tag, data, cmn.NewChecksum(data))
+}
+
+// sendPieces sends data as a CHUNKINFO followed by pieces. If ctx is
+// cancelled, it stops at the next piece.
+func (h SeederServerReqHandler) sendPieces(ctx context.Context, tag uint32, data []byte, checksum cmn.Checksum) error {
+	pieceSize := h.pieceSize()
+	npieces := uint64(len(data) / pieceSize)
+	if len(data)%pieceSize != 0 {
+		npieces++
+	}
+	rsp := swp.Chunkinfo{
+		NPieces:  npieces,
+		Checksum: uint64(checksum),
+	}
+	if err := h.wire.SendTagged(tag, rsp); err != nil {
+		logger.Println(err)
+		return err
+	}
+	for off := 0; off < len(data); off += pieceSize {
+		if ctx.Err() != nil {
+			return nil
+		}
+		end := off + pieceSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := h.wire.SendTagged(tag, swp.Piece{Piece: data[off:end]}); err != nil {
 			logger.Println(err)
 			return err
 		}
@@ -174,13 +520,45 @@ func (h SeederServerReqHandler) handleGetchunk(index uint64) error {
 	return nil
 }
 
-func readChunk(f *os.File, i uint64) ([]byte, int, error) {
-	r := io.NewSectionReader(f, int64(cmn.ChunkSize*i), cmn.ChunkSize)
-	b := chunkPool.Get().([]byte)
-	n, err := r.Read(b)
-	if err != io.EOF && err != nil {
-		logger.Println(n, err)
-		return nil, 0, err
+func (h SeederServerReqHandler) handleGetchecksums(tag uint32, handle swp.Handle, start uint64) error {
+	of, err := h.acquire(tag, handle)
+	if err != nil {
+		return err
+	}
+	defer h.files.release(of)
+	checksums, err := h.db.GetChecksums(of.id)
+	if err != nil {
+		logger.Println(err)
+		return h.sendError(tag, swp.ERR_UNKNOWN_ID, err)
+	}
+	total := uint64(len(checksums))
+	if start > total {
+		start = total
+	}
+	end := start + swp.MaxChecksums
+	if end > total {
+		end = total
+	}
+	rsp := swp.Checksums{
+		Total:     total,
+		Checksums: make([]uint64, end-start),
+	}
+	for i := range rsp.Checksums {
+		rsp.Checksums[i] = uint64(checksums[start+uint64(i)])
+	}
+	if err := h.wire.SendTagged(tag, rsp); err != nil {
+		logger.Println(err)
+		return err
+	}
+	return nil
+}
+
+// sendError tells the client that its request failed and returns err, or
+// the error of sending the message.
+func (h SeederServerReqHandler) sendError(tag uint32, code swp.ErrCode, err error) error {
+	if sendErr := h.wire.SendTagged(tag, swp.Error{Code: code, Text: err.Error()}); sendErr != nil {
+		logger.Println(sendErr)
+		return sendErr
 	}
-	return b, n, nil
+	return err
 }
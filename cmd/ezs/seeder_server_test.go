@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aburdulescu/ez/cmn"
+	"github.com/aburdulescu/ez/ezt"
+	"github.com/aburdulescu/ez/swp"
+)
+
+// BenchmarkSendChunk sends a chunk to a client over TCP, by reading it in
+// memory first as GETRANGE does, and straight from the file as GETCHUNK
+// does.
+func BenchmarkSendChunk(b *testing.B) {
+	logger = &NopLogger{log.New(io.Discard, "", 0)}
+	maxPieceSize = 256 << 10
+
+	path := filepath.Join(b.TempDir(), "chunk")
+	data := make([]byte, cmn.ChunkSize)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	of := &openFile{path: path, f: f}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	local := swp.NewHello("ezs", maxPieceSize+swp.Piece{}.Size()+swp.TagSize)
+	proto, err := swp.Negotiate(local, swp.NewHello("ez", swp.DefaultMaxFrame))
+	if err != nil {
+		b.Fatal(err)
+	}
+	h := SeederServerReqHandler{
+		conn:  conn,
+		wire:  swp.NewConn(conn),
+		proto: proto,
+		cork:  &corker{conn: conn},
+	}
+	h.wire.SetFraming(swp.FramingFor(proto))
+	ctx := context.Background()
+
+	b.Run("Buffered", func(b *testing.B) {
+		b.SetBytes(cmn.ChunkSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := chunkPool.Get().([]byte)
+			if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+				b.Fatal(err)
+			}
+			if err := h.sendPieces(ctx, 0, buf, 0); err != nil {
+				b.Fatal(err)
+			}
+			chunkPool.Put(buf)
+		}
+	})
+	b.Run("Sendfile", func(b *testing.B) {
+		b.SetBytes(cmn.ChunkSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := h.sendChunk(ctx, 0, of, 0, cmn.ChunkSize, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// newTestHandler returns a handler serving the file at path, as if it was
+// shared with size bytes, over a TCP connection to client.
+func newTestHandler(t *testing.T, path string, size int64, client swp.Hello) (SeederServerReqHandler, *swp.Conn) {
+	t.Helper()
+	h, wire, _ := newTestHandlerConn(t, path, size, client)
+	return h, wire
+}
+
+// newTestHandlerConn is newTestHandler which also returns the connection of
+// the client, to write to it what the client wouldn't.
+func newTestHandlerConn(t *testing.T, path string, size int64, client swp.Hello) (SeederServerReqHandler, *swp.Conn, net.Conn) {
+	t.Helper()
+	logger = &NopLogger{log.New(io.Discard, "", 0)}
+	maxPieceSize = 256 << 10
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cconn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cconn.Close() })
+	sconn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sconn.Close() })
+	// small buffers, so that a chunk doesn't fit in them before the client
+	// reads it
+	cconn.(*net.TCPConn).SetReadBuffer(64 << 10)
+	sconn.(*net.TCPConn).SetWriteBuffer(64 << 10)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := newFileTable()
+	files.set(0, &openFile{path: path, f: f, ifile: ezt.IFile{Size: size}})
+	t.Cleanup(files.closeAll)
+
+	local := swp.NewHello("ezs", maxPieceSize+swp.Piece{}.Size()+swp.TagSize)
+	proto, err := swp.Negotiate(local, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := SeederServerReqHandler{
+		conn:  sconn,
+		wire:  swp.NewConn(sconn),
+		files: files,
+		proto: proto,
+		cork:  &corker{conn: sconn},
+	}
+	h.wire.SetFraming(swp.FramingFor(proto))
+	wire := swp.NewConn(cconn)
+	wire.SetFraming(swp.FramingFor(proto))
+	return h, wire, cconn
+}
+
+// TestGetrangeShortRead checks that a file which got shorter since it was
+// shared is reported instead of sending what was in the buffer.
+func TestGetrangeShortRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, wire := newTestHandler(t, path, 3000, swp.NewHello("ez", swp.DefaultMaxFrame))
+	go h.handleGetrange(context.Background(), 7, 0, 500, 2000)
+
+	tag, rsp, cleanup, err := wire.RecvTagged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if tag != 7 {
+		t.Fatalf("expected tag 7, got %d", tag)
+	}
+	if rsp.Type() != swp.ERROR || rsp.(swp.Error).Code != swp.ERR_IO {
+		t.Fatalf("expected ERR_IO, got %v", rsp)
+	}
+}
+
+// TestIdleWhileBusy checks that a frame which the client sends slowly, while
+// a request is being served, is read whole, and that the connection is
+// closed once it's idle.
+func TestIdleWhileBusy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	data := make([]byte, 4<<20)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	idleTimeout = 100 * time.Millisecond
+	defer func() { idleTimeout = 0 }()
+	h, wire, cconn := newTestHandlerConn(t, path, int64(len(data)), swp.NewHello("ez", swp.DefaultMaxFrame))
+	done := make(chan struct{})
+	go func() {
+		h.run()
+		close(done)
+	}()
+
+	// the range doesn't fit in the socket buffers, it's being sent until
+	// the client reads it
+	if err := wire.SendTagged(1, swp.Getrange{Handle: 0, Offset: 0, Length: uint64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	var ping bytes.Buffer
+	frame := swp.NewConn(&ping)
+	frame.SetFraming(wire.Framing())
+	if err := frame.SendTagged(2, swp.Ping{Seq: 7}); err != nil {
+		t.Fatal(err)
+	}
+	half := ping.Len() / 2
+	if _, err := cconn.Write(ping.Next(half)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * idleTimeout)
+	if _, err := cconn.Write(ping.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	pong := false
+	left := len(data)
+	for !pong || left != 0 {
+		tag, rsp, cleanup, err := wire.RecvTagged()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case rsp.Type() == swp.PONG:
+			if tag != 2 || rsp.(swp.Pong).Seq != 7 {
+				t.Fatalf("unexpected PONG %v with tag %d", rsp, tag)
+			}
+			pong = true
+		case rsp.Type() == swp.PIECE:
+			left -= len(rsp.(swp.Piece).Piece)
+		case rsp.Type() == swp.ERROR:
+			t.Fatal("unexpected error:", rsp)
+		}
+		cleanup()
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * idleTimeout):
+		t.Fatal("idle connection was not closed")
+	}
+}
+
+// TestOpenClose opens files next to the one opened with CONNECT, up to
+// MAX_OPEN_FILES, and checks that they are all closed with the connection.
+func TestOpenClose(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 1000)
+	rand.Read(data)
+	if err := os.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checksums := []cmn.Checksum{cmn.NewChecksum(data)}
+	id := cmn.NewID(checksums)
+	if err := db.Add(id, ezt.IFile{Name: "file", Dir: dir, Size: int64(len(data))}, checksums); err != nil {
+		t.Fatal(err)
+	}
+	h, wire, cconn := newTestHandlerConn(t, filepath.Join(dir, "file"), int64(len(data)), swp.NewHello("ez", swp.DefaultMaxFrame))
+	h.db = db
+	done := make(chan struct{})
+	go func() {
+		h.run()
+		close(done)
+	}()
+
+	tag := uint32(0)
+	request := func(t *testing.T, req swp.Msg) swp.Msg {
+		t.Helper()
+		tag++
+		if err := wire.SendTagged(tag, req); err != nil {
+			t.Fatal(err)
+		}
+		rtag, rsp, cleanup, err := wire.RecvTagged()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup()
+		if rtag != tag {
+			t.Fatalf("expected tag %d, got %d", tag, rtag)
+		}
+		return rsp
+	}
+	expectError := func(t *testing.T, rsp swp.Msg, code swp.ErrCode) {
+		t.Helper()
+		if rsp.Type() != swp.ERROR || rsp.(swp.Error).Code != code {
+			t.Fatalf("expected %v, got %v", code, rsp)
+		}
+	}
+	open := func(t *testing.T) swp.Handle {
+		t.Helper()
+		rsp := request(t, swp.Open{Id: id})
+		if rsp.Type() != swp.OPENED {
+			t.Fatal("expected OPENED, got", rsp)
+		}
+		return rsp.(swp.Opened).Handle
+	}
+
+	t.Run("Open", func(t *testing.T) {
+		expectError(t, request(t, swp.Open{Id: "unknown"}), swp.ERR_UNKNOWN_ID)
+		handle := open(t)
+		if handle == 0 {
+			t.Fatal("handle 0 belongs to CONNECT")
+		}
+		if next := open(t); next == handle {
+			t.Fatal("handle given twice:", next)
+		}
+		tag++
+		if err := wire.SendTagged(tag, swp.Getrange{Handle: handle, Offset: 0, Length: uint64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, got := recvChunk(t, wire, tag); !bytes.Equal(got, data) {
+			t.Fatal("range differs")
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		handle := open(t)
+		if rsp := request(t, swp.Close{Handle: handle}); rsp.Type() != swp.ACK {
+			t.Fatal("expected ACK, got", rsp)
+		}
+		expectError(t, request(t, swp.Getrange{Handle: handle, Offset: 0, Length: 1}), swp.ERR_NOT_CONNECTED)
+		expectError(t, request(t, swp.Close{Handle: handle}), swp.ERR_NOT_CONNECTED)
+		expectError(t, request(t, swp.Close{Handle: 0}), swp.ERR_BAD_REQUEST)
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		for i := 0; ; i++ {
+			rsp := request(t, swp.Open{Id: id})
+			if rsp.Type() == swp.ERROR {
+				expectError(t, rsp, swp.ERR_BUSY)
+				break
+			}
+			if i == MAX_OPEN_FILES {
+				t.Fatal("more than", MAX_OPEN_FILES, "files were opened")
+			}
+		}
+		h.files.mu.Lock()
+		n := len(h.files.files)
+		h.files.mu.Unlock()
+		// besides the one opened with CONNECT
+		if n != MAX_OPEN_FILES+1 {
+			t.Fatalf("expected %d open files, got %d", MAX_OPEN_FILES+1, n)
+		}
+	})
+
+	t.Run("CloseAll", func(t *testing.T) {
+		var files []*os.File
+		h.files.mu.Lock()
+		for _, of := range h.files.files {
+			files = append(files, of.f)
+		}
+		h.files.mu.Unlock()
+		cconn.Close()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed")
+		}
+		for _, f := range files {
+			if _, err := f.Stat(); !errors.Is(err, os.ErrClosed) {
+				t.Fatal("file left open after the connection was closed")
+			}
+		}
+	})
+}
+
+// recvChunk reads the answer to a chunk request with the given tag and
+// returns its checksum and data.
+func recvChunk(t *testing.T, wire *swp.Conn, tag uint32) (cmn.Checksum, []byte) {
+	t.Helper()
+	rtag, rsp, cleanup, err := wire.RecvTagged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if rtag != tag {
+		t.Fatalf("expected tag %d, got %d", tag, rtag)
+	}
+	if rsp.Type() != swp.CHUNKINFO {
+		t.Fatalf("expected CHUNKINFO, got %v", rsp.Type())
+	}
+	info := rsp.(swp.Chunkinfo)
+	var data []byte
+	for i := uint64(0); i < info.NPieces; i++ {
+		rtag, rsp, cleanup, err := wire.RecvTagged()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtag != tag || rsp.Type() != swp.PIECE {
+			t.Fatalf("expected PIECE with tag %d, got %v with tag %d", tag, rsp.Type(), rtag)
+		}
+		data = append(data, rsp.(swp.Piece).Piece...)
+		cleanup()
+	}
+	return cmn.Checksum(info.Checksum), data
+}
+
+// TestSendChunk sends chunks from a file with sendfile and checks what the
+// client receives, for every framing.
+func TestSendChunk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	data := make([]byte, cmn.ChunkSize+3*cmn.PieceSize+100)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(data))
+	chunks := [][]byte{data[:cmn.ChunkSize], data[cmn.ChunkSize:]}
+
+	tagged := swp.NewHello("ez", swp.DefaultMaxFrame)
+	untagged := tagged
+	untagged.Caps = 0
+	narrow := tagged
+	narrow.Caps = swp.CapRequestIds
+
+	for _, tt := range []struct {
+		name  string
+		hello swp.Hello
+	}{
+		{"Tagged", tagged},
+		{"TaggedNarrow", narrow},
+		{"Untagged", untagged},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h, wire := newTestHandler(t, path, size, tt.hello)
+			of := h.files.acquire(0)
+			defer h.files.release(of)
+			tag := uint32(0)
+			if h.wire.Framing().Tagged {
+				tag = 5
+			}
+			for i, chunk := range chunks {
+				errc := make(chan error, 1)
+				go func() {
+					errc <- h.sendChunk(context.Background(), tag, of, int64(i)*cmn.ChunkSize, int64(len(chunk)), cmn.NewChecksum(chunk))
+				}()
+				checksum, got := recvChunk(t, wire, tag)
+				if err := <-errc; err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, chunk) {
+					t.Fatalf("chunk %d differs", i)
+				}
+				if checksum != cmn.NewChecksum(got) {
+					t.Fatalf("checksum of chunk %d differs", i)
+				}
+			}
+			if h.cork.users != 0 {
+				t.Fatalf("connection left corked by %d users", h.cork.users)
+			}
+		})
+	}
+
+	t.Run("Concurrent", func(t *testing.T) {
+		h, wire := newTestHandler(t, path, size, tagged)
+		of := h.files.acquire(0)
+		defer h.files.release(of)
+		errc := make(chan error, len(chunks))
+		for i, chunk := range chunks {
+			go func(i int, chunk []byte) {
+				errc <- h.sendChunk(context.Background(), uint32(i+1), of, int64(i)*cmn.ChunkSize, int64(len(chunk)), cmn.NewChecksum(chunk))
+			}(i, chunk)
+		}
+		// the frames of the two chunks are interleaved, sort them by tag
+		got := make([][]byte, len(chunks))
+		left := make([]int64, len(chunks))
+		for i := range left {
+			left[i] = -1
+		}
+		for done := 0; done < len(chunks); {
+			tag, rsp, cleanup, err := wire.RecvTagged()
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := int(tag) - 1
+			switch rsp.Type() {
+			case swp.CHUNKINFO:
+				if cmn.Checksum(rsp.(swp.Chunkinfo).Checksum) != cmn.NewChecksum(chunks[i]) {
+					t.Fatalf("checksum of chunk %d differs", i)
+				}
+				left[i] = int64(rsp.(swp.Chunkinfo).NPieces)
+			case swp.PIECE:
+				got[i] = append(got[i], rsp.(swp.Piece).Piece...)
+				left[i]--
+			}
+			cleanup()
+			if left[i] == 0 {
+				done++
+			}
+		}
+		for range chunks {
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range chunks {
+			if !bytes.Equal(got[i], chunks[i]) {
+				t.Fatalf("chunk %d differs", i)
+			}
+		}
+		if h.cork.users != 0 {
+			t.Fatalf("connection left corked by %d users", h.cork.users)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		h, wire := newTestHandler(t, path, size, tagged)
+		of := h.files.acquire(0)
+		defer h.files.release(of)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errc := make(chan error, 1)
+		go func() {
+			err := h.sendChunk(ctx, 1, of, 0, cmn.ChunkSize, 0)
+			// marks the end of the answer
+			h.wire.SendTagged(1, swp.Ack{})
+			errc <- err
+		}()
+
+		_, rsp, cleanup, err := wire.RecvTagged()
+		if err != nil {
+			t.Fatal(err)
+		}
+		npieces := rsp.(swp.Chunkinfo).NPieces
+		cleanup()
+		cancel()
+		var got []byte
+		for {
+			_, rsp, cleanup, err := wire.RecvTagged()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rsp.Type() == swp.ACK {
+				cleanup()
+				break
+			}
+			got = append(got, rsp.(swp.Piece).Piece...)
+			cleanup()
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if uint64(len(got)) >= npieces*uint64(h.pieceSize()) {
+			t.Fatal("whole chunk was sent after it was cancelled")
+		}
+		if !bytes.Equal(got, data[:len(got)]) {
+			t.Fatal("pieces sent before the cancel differ")
+		}
+		if h.cork.users != 0 {
+			t.Fatalf("connection left corked by %d users", h.cork.users)
+		}
+	})
+}
+
+// TestSendChunkMoved checks that a file which was renamed or replaced since
+// it was opened is never served with the content now at its path.
+func TestSendChunkMoved(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		move func(t *testing.T, path string)
+	}{
+		{"Renamed", func(t *testing.T, path string) {
+			if err := os.Rename(path, path+".old"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"Replaced", func(t *testing.T, path string) {
+			other := make([]byte, 3*cmn.PieceSize)
+			if err := os.WriteFile(path+".new", other, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(path+".new", path); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			data := make([]byte, 3*cmn.PieceSize)
+			rand.Read(data)
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			h, wire := newTestHandler(t, path, int64(len(data)), swp.NewHello("ez", swp.DefaultMaxFrame))
+			of := h.files.acquire(0)
+			defer h.files.release(of)
+			tt.move(t, path)
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- h.sendChunk(context.Background(), 3, of, 0, int64(len(data)), cmn.NewChecksum(data))
+			}()
+			_, rsp, cleanup, err := wire.RecvTagged()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch rsp.Type() {
+			case swp.ERROR:
+				// the file couldn't be opened again
+				if rsp.(swp.Error).Code != swp.ERR_IO {
+					t.Fatalf("expected ERR_IO, got %v", rsp)
+				}
+				cleanup()
+			case swp.CHUNKINFO:
+				npieces := rsp.(swp.Chunkinfo).NPieces
+				cleanup()
+				var got []byte
+				for i := uint64(0); i < npieces; i++ {
+					_, rsp, cleanup, err := wire.RecvTagged()
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, rsp.(swp.Piece).Piece...)
+					cleanup()
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatal("served the content now at the path")
+				}
+			default:
+				t.Fatalf("unexpected %v", rsp.Type())
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
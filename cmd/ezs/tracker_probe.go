@@ -44,7 +44,6 @@ func (s TrackerProbeServer) ListenAndServe() {
 		logger.Println("tracker sent probe")
 		if err := updateTracker(s.db); err != nil {
 			logger.Println(err)
-			return
 		}
 	}
 }
@@ -55,6 +54,14 @@ func updateTracker(db *DB) error {
 	if err != nil {
 		return err
 	}
+	for i := range files {
+		checksums, err := db.GetChecksums(files[i].Id)
+		if err != nil {
+			return err
+		}
+		manifest := ezt.NewManifest(files[i].IFile.Size, checksums)
+		files[i].Manifest = &manifest
+	}
 	trackerClient := ezt.NewClient(trackerURL)
 	req := ezt.AddRequest{
 		Files: files,
@@ -3,10 +3,17 @@ package main
 import (
 	"os"
 
+	"github.com/aburdulescu/ez/cmn"
 	"github.com/aburdulescu/ez/ezt"
 )
 
-func AddFile(db *DB, path string) (string, error) {
+// AddFile adds the file at path to db, with the tags and description of
+// meta, and sends it to the tracker.
+func AddFile(db *DB, path string, meta ezt.Metadata) (string, error) {
+	tags, err := ezt.NormalizeTags(meta.Tags)
+	if err != nil {
+		return "", err
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
@@ -16,21 +23,24 @@ func AddFile(db *DB, path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	i.Meta.Tags = tags
+	i.Meta.Desc = meta.Desc
 	checksums, err := ProcessFile(f, i.Size)
 	if err != nil {
 		return "", err
 	}
-	id := NewID(checksums)
+	id := cmn.NewID(checksums)
 	if err != nil {
 		return "", err
 	}
 	if err := db.Add(id, i, checksums); err != nil {
 		return "", err
 	}
+	manifest := ezt.NewManifest(i.Size, checksums)
 	trackerClient := ezt.NewClient(trackerURL)
 	req := ezt.AddRequest{
 		Files: []ezt.File{
-			ezt.File{Id: id, IFile: i},
+			ezt.File{Id: id, IFile: i, Manifest: &manifest},
 		},
 		Addr: seedAddr,
 	}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aburdulescu/ez/ezt"
+)
+
+// The v1 API:
+//
+//	GET    /v1/files                    list the files, see ezt.Query
+//	POST   /v1/files                    register the files of a peer
+//	GET    /v1/files/{id}               the file with its peers
+//	GET    /v1/files/{id}/manifest      the manifest of the file
+//	GET    /v1/files/{id}/peers         the peers of the file
+//	DELETE /v1/files/{id}/peers/{addr}  unregister a peer of the file
+//	POST   /v1/heartbeat                renew the lease of a peer
+//
+// Errors are sent as an ezt.ErrorResponse.
+
+func (s Server) handleV1Files(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	defer r.Body.Close()
+	switch r.Method {
+	case "GET":
+		q, err := ezt.ParseQuery(r.URL.Query())
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		files, err := s.c.Query(q)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		respond(w, &files)
+	case "POST":
+		var req ezt.AddRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("could not decode body: %v", err))
+			return
+		}
+		if status, err := s.addFiles(req); err != nil {
+			respondError(w, status, err)
+		}
+	default:
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+func (s Server) handleV1File(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	defer r.Body.Close()
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/v1/files/"), "/")
+	for i := range parts {
+		p, err := url.PathUnescape(parts[i])
+		if err != nil || p == "" {
+			respondError(w, http.StatusNotFound, errors.New("unknown resource"))
+			return
+		}
+		parts[i] = p
+	}
+	id := parts[0]
+	switch {
+	case len(parts) == 1:
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		v, err := s.c.Get(id)
+		if err != nil {
+			respondError(w, statusOf(err), err)
+			return
+		}
+		respond(w, &v)
+	case len(parts) == 2 && parts[1] == "manifest":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		m, err := s.c.GetManifest(id)
+		if err != nil {
+			respondError(w, statusOf(err), err)
+			return
+		}
+		respond(w, &m)
+	case len(parts) == 2 && parts[1] == "peers":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		v, err := s.c.Get(id)
+		if err != nil {
+			respondError(w, statusOf(err), err)
+			return
+		}
+		rsp := ezt.PeersResponse{Peers: v.Peers, LastSeen: v.LastSeen}
+		respond(w, &rsp)
+	case len(parts) == 3 && parts[1] == "peers":
+		if r.Method != "DELETE" {
+			methodNotAllowed(w, "DELETE")
+			return
+		}
+		if err := s.c.Del(id, parts[2]); err != nil {
+			respondError(w, statusOf(err), err)
+		}
+	default:
+		respondError(w, http.StatusNotFound, errors.New("unknown resource"))
+	}
+}
+
+func (s Server) handleV1Heartbeat(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	var req ezt.HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("could not decode body: %v", err))
+		return
+	}
+	if !s.c.Heartbeat(req.Addr) {
+		respondError(w, http.StatusNotFound, fmt.Errorf("peer '%s' must register again", req.Addr))
+		return
+	}
+	rsp := ezt.HeartbeatResponse{Lease: int64(lease / time.Second)}
+	respond(w, &rsp)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	respondError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+func respondError(w http.ResponseWriter, status int, err error) {
+	rsp := ezt.ErrorResponse{Error: ezt.Error{Status: status, Message: err.Error()}}
+	b, _ := json.Marshal(&rsp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aburdulescu/ez/cmn"
+	"github.com/aburdulescu/ez/ezt"
+)
+
+func TestAPI(t *testing.T) {
+	s := Server{NewKV()}
+	mux := http.NewServeMux()
+	s.register(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	c := ezt.NewClient(ts.URL + "/")
+
+	checksums := []cmn.Checksum{1, 2}
+	m := ezt.NewManifest(cmn.ChunkSize+1, checksums)
+	f := ezt.File{Id: cmn.NewID(checksums), IFile: ezt.IFile{Name: "a", Dir: "/a", Size: cmn.ChunkSize + 1}, Manifest: &m}
+
+	t.Run("Add", func(t *testing.T) {
+		if err := c.Add(ezt.AddRequest{Files: []ezt.File{f}, Addr: "1"}); err != nil {
+			t.Fatal(err)
+		}
+		files, err := c.GetAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files.Files) != 1 || files.Files[0].Id != f.Id {
+			t.Fatal("unexpected files:", files)
+		}
+		rsp, err := c.Get(ezt.GetRequest{Id: f.Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rsp.IFile.Equals(f.IFile) || !Peers(rsp.Peers).equals(Peers{"1"}) {
+			t.Fatal("unexpected file:", rsp)
+		}
+		peers, err := c.GetPeers(ezt.GetRequest{Id: f.Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Peers(peers.Peers).equals(Peers{"1"}) || peers.LastSeen["1"].IsZero() {
+			t.Fatal("unexpected peers:", peers)
+		}
+		if _, err := c.GetManifest(ezt.GetManifestRequest{Id: f.Id}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("BadRequest", func(t *testing.T) {
+		short := ezt.NewManifest(cmn.ChunkSize+1, checksums[:1])
+		bad := ezt.File{Id: f.Id, IFile: f.IFile, Manifest: &short}
+		good := ezt.File{Id: "3", IFile: ezt.IFile{Name: "c", Size: 1}}
+		err := c.Add(ezt.AddRequest{Files: []ezt.File{good, bad}, Addr: "2"})
+		if !errors.Is(err, ezt.ErrBadRequest) {
+			t.Fatal("expected bad request, got", err)
+		}
+		// nothing of a rejected request is registered
+		if _, err := c.Get(ezt.GetRequest{Id: good.Id}); !errors.Is(err, ezt.ErrNotFound) {
+			t.Fatal("expected the valid file to be rejected too, got", err)
+		}
+		if _, err := c.Heartbeat(ezt.HeartbeatRequest{Addr: "2"}); !errors.Is(err, ezt.ErrUnknownPeer) {
+			t.Fatal("expected the peer to stay unknown, got", err)
+		}
+		if _, err := c.List(ezt.Query{Regex: "("}); !errors.Is(err, ezt.ErrBadRequest) {
+			t.Fatal("expected bad request, got", err)
+		}
+		var e *ezt.Error
+		if !errors.As(err, &e) || e.Status != http.StatusBadRequest || e.Message == "" {
+			t.Fatal("unexpected error:", err)
+		}
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		bad := ezt.File{Id: "2", IFile: ezt.IFile{Name: "b", Size: 1, Meta: &ezt.Metadata{Tags: []string{"two words"}}}}
+		if err := c.Add(ezt.AddRequest{Files: []ezt.File{bad}, Addr: "1"}); !errors.Is(err, ezt.ErrBadRequest) {
+			t.Fatal("expected bad request, got", err)
+		}
+		tagged := ezt.File{Id: "2", IFile: ezt.IFile{Name: "b", Size: 1, Meta: &ezt.Metadata{Tags: []string{"Build"}, Desc: "nightly"}}}
+		if err := c.Add(ezt.AddRequest{Files: []ezt.File{tagged}, Addr: "1"}); err != nil {
+			t.Fatal(err)
+		}
+		files, err := c.List(ezt.Query{Tags: []string{"build"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files.Files) != 1 || files.Files[0].Id != "2" || files.Files[0].Desc != "nightly" {
+			t.Fatal("unexpected files:", files)
+		}
+		if err := c.Remove(ezt.RemoveRequest{Id: "2", Addr: "1"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		other := ezt.File{Id: f.Id, IFile: ezt.IFile{Name: "a", Dir: "/a", Size: 1}}
+		err := c.Add(ezt.AddRequest{Files: []ezt.File{other}, Addr: "2"})
+		if !errors.Is(err, ezt.ErrConflict) {
+			t.Fatal("expected conflict, got", err)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		if _, err := c.Get(ezt.GetRequest{Id: "missing"}); !errors.Is(err, ezt.ErrNotFound) {
+			t.Fatal("expected not found, got", err)
+		}
+		if _, err := c.GetManifest(ezt.GetManifestRequest{Id: "missing"}); !errors.Is(err, ezt.ErrNotFound) {
+			t.Fatal("expected not found, got", err)
+		}
+		if err := c.Remove(ezt.RemoveRequest{Id: f.Id, Addr: "2"}); !errors.Is(err, ezt.ErrNotFound) {
+			t.Fatal("expected not found, got", err)
+		}
+		if _, err := c.Heartbeat(ezt.HeartbeatRequest{Addr: "3"}); !errors.Is(err, ezt.ErrUnknownPeer) {
+			t.Fatal("expected unknown peer, got", err)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		if err := c.Remove(ezt.RemoveRequest{Id: f.Id, Addr: "1"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Get(ezt.GetRequest{Id: f.Id}); !errors.Is(err, ezt.ErrNotFound) {
+			t.Fatal("expected not found, got", err)
+		}
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		rsp, err := http.Get(ts.URL + "/?id=all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal("unexpected status:", rsp.Status)
+		}
+		rsp, err = http.Get(ts.URL + "/?id=missing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusNotFound {
+			t.Fatal("unexpected status:", rsp.Status)
+		}
+	})
+}
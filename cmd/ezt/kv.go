@@ -1,70 +1,374 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/aburdulescu/ez/ezt"
 )
 
 type Value ezt.GetResponse
 
+// ErrNotFound is wrapped by the errors returned for missing keys and peers.
+var ErrNotFound = errors.New("not found")
+
+// ConflictError is returned by AddFiles for the files whose size doesn't
+// match the one already known for their id.
+type ConflictError struct {
+	Ids []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("size doesn't match the known one for: %v", e.Ids)
+}
+
 type KV struct {
-	mu   sync.RWMutex
-	data map[string]Value
+	mu        sync.RWMutex
+	data      map[string]Value
+	manifests map[string]ezt.Manifest
+	// added holds when each key was added first.
+	added map[string]time.Time
+	// metas holds the metadata sent by each peer of each key, the one of
+	// the key merges them.
+	metas map[string]map[string]*ezt.Metadata
+	// tags holds the keys of each tag.
+	tags  map[string]map[string]bool
+	store Store
+	// unverified holds the peers loaded from the store which didn't
+	// register again since the tracker started.
+	unverified map[string]bool
+	// seen holds when each peer registered or sent a heartbeat last.
+	seen map[string]time.Time
+	now  func() time.Time
 }
 
+// NewKV returns a KV which is kept only in memory.
 func NewKV() *KV {
-	return &KV{data: make(map[string]Value)}
+	return &KV{
+		data:       make(map[string]Value),
+		manifests:  make(map[string]ezt.Manifest),
+		added:      make(map[string]time.Time),
+		metas:      make(map[string]map[string]*ezt.Metadata),
+		tags:       make(map[string]map[string]bool),
+		store:      nopStore{},
+		unverified: make(map[string]bool),
+		seen:       make(map[string]time.Time),
+		now:        time.Now,
+	}
+}
+
+// OpenKV returns a KV which writes its changes to store, filled with the
+// records found there. The peers of those records are unverified until
+// they register again and their leases start when they are loaded.
+func OpenKV(store Store) (*KV, error) {
+	records, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	kv := NewKV()
+	kv.store = store
+	now := kv.now()
+	for k, r := range records {
+		if len(r.Peers) == 0 {
+			continue
+		}
+		if r.Metas == nil {
+			// stored before the metadata was kept by peer
+			r.Metas = make(map[string]*ezt.Metadata, len(r.Peers))
+			for _, peer := range r.Peers {
+				r.Metas[peer] = r.IFile.Meta
+			}
+		}
+		r.IFile.Meta = mergeMeta(r.Metas, r.Peers)
+		if r.Added.IsZero() {
+			r.Added = now
+		}
+		kv.apply(k, &r)
+		for _, peer := range r.Peers {
+			kv.unverified[peer] = true
+			kv.seen[peer] = now
+		}
+	}
+	return kv, nil
+}
+
+func (kv *KV) Add(k string, ifile ezt.IFile, peer string) error {
+	return kv.AddFiles(peer, []ezt.File{{Id: k, IFile: ifile}})
 }
 
-func (kv *KV) Add(k string, ifile ezt.IFile, peer string) {
+// AddFiles registers peer for all files and stores their manifests, the
+// caller must verify them first. The changes are saved at once and kept
+// only if that succeeds. Files which conflict with the known ones are
+// skipped and reported in a ConflictError.
+func (kv *KV) AddFiles(peer string, files []ezt.File) error {
 	kv.mu.Lock()
-	v, ok := kv.data[k]
-	value := Value{IFile: ifile}
-	if ok {
-		value.Peers = v.Peers
-		if findInSlice(v.Peers, peer) == -1 {
-			value.Peers = append(v.Peers, peer)
+	defer kv.mu.Unlock()
+	now := kv.now()
+	changes := make(map[string]*Record, len(files))
+	var conflicts []string
+	for _, f := range files {
+		r, ok := changes[f.Id]
+		if !ok {
+			r = kv.record(f.Id)
+		}
+		if r != nil && r.IFile.Size != f.IFile.Size {
+			conflicts = append(conflicts, f.Id)
+			continue
+		}
+		if r == nil {
+			r = &Record{Added: now, Metas: make(map[string]*ezt.Metadata)}
+			if m, ok := kv.manifests[f.Id]; ok {
+				r.Manifest = &m
+			}
+		}
+		if findInSlice(r.Peers, peer) == -1 {
+			peers := make([]string, 0, len(r.Peers)+1)
+			r.Peers = append(append(peers, r.Peers...), peer)
 		}
-	} else {
-		value.Peers = []string{peer}
+		// the metadata sent now replaces what peer sent before
+		r.Metas[peer] = f.IFile.Meta
+		r.IFile = f.IFile
+		r.IFile.Meta = mergeMeta(r.Metas, r.Peers)
+		if f.Manifest != nil {
+			r.Manifest = f.Manifest
+		}
+		changes[f.Id] = r
+	}
+	if err := kv.store.Save(changes); err != nil {
+		return err
+	}
+	for k, r := range changes {
+		kv.apply(k, r)
 	}
-	kv.data[k] = value
-	kv.mu.Unlock()
+	delete(kv.unverified, peer)
+	kv.seen[peer] = now
+	if len(conflicts) != 0 {
+		return &ConflictError{conflicts}
+	}
+	return nil
 }
 
 func (kv *KV) Del(k string, peer string) error {
 	kv.mu.Lock()
-	v, ok := kv.data[k]
-	if !ok {
-		kv.mu.Unlock()
-		return fmt.Errorf("key '%s' does not exist", k)
+	defer kv.mu.Unlock()
+	r := kv.record(k)
+	if r == nil {
+		return fmt.Errorf("key '%s' does not exist: %w", k, ErrNotFound)
 	}
-	i := findInSlice(v.Peers, peer)
+	i := findInSlice(r.Peers, peer)
 	if i == -1 {
-		kv.mu.Unlock()
-		return fmt.Errorf("peer '%s' does not exist for key '%s'", peer, k)
-	}
-	v.Peers[i] = v.Peers[len(v.Peers)-1]
-	v.Peers = v.Peers[:len(v.Peers)-1]
-	kv.data[k] = v
-	if len(v.Peers) != 0 {
-		kv.mu.Unlock()
+		return fmt.Errorf("peer '%s' does not exist for key '%s': %w", peer, k, ErrNotFound)
+	}
+	r = withoutPeer(r, i)
+	if err := kv.store.Save(map[string]*Record{k: r}); err != nil {
+		return err
+	}
+	kv.apply(k, r)
+	return nil
+}
+
+// withoutPeer returns r without its i-th peer, nil if it was the last one.
+// The peers are copied since Get hands them out.
+func withoutPeer(r *Record, i int) *Record {
+	if len(r.Peers) == 1 {
 		return nil
 	}
-	delete(kv.data, k)
-	kv.mu.Unlock()
+	next := *r
+	peers := make([]string, 0, len(r.Peers)-1)
+	peers = append(peers, r.Peers[:i]...)
+	next.Peers = append(peers, r.Peers[i+1:]...)
+	next.Metas = make(map[string]*ezt.Metadata, len(next.Peers))
+	for _, peer := range next.Peers {
+		next.Metas[peer] = r.Metas[peer]
+	}
+	next.IFile.Meta = mergeMeta(next.Metas, next.Peers)
+	return &next
+}
+
+// mergeMeta returns the metadata of a file from what its peers sent.
+func mergeMeta(metas map[string]*ezt.Metadata, peers []string) *ezt.Metadata {
+	var meta *ezt.Metadata
+	for _, peer := range peers {
+		meta = meta.Merge(metas[peer])
+	}
+	return meta
+}
+
+// apply sets k to r in memory, or removes k with its manifest if r is nil.
+func (kv *KV) apply(k string, r *Record) {
+	kv.indexTags(k, kv.data[k].IFile.Meta, nil)
+	if r == nil {
+		delete(kv.data, k)
+		delete(kv.metas, k)
+		delete(kv.manifests, k)
+		delete(kv.added, k)
+		return
+	}
+	kv.data[k] = Value{IFile: r.IFile, Peers: r.Peers}
+	kv.metas[k] = r.Metas
+	if r.Manifest != nil {
+		kv.manifests[k] = *r.Manifest
+	}
+	kv.added[k] = r.Added
+	kv.indexTags(k, nil, r.IFile.Meta)
+}
+
+// indexTags replaces the tags of k from prev with the ones from next.
+func (kv *KV) indexTags(k string, prev, next *ezt.Metadata) {
+	if prev != nil {
+		for _, t := range prev.Tags {
+			delete(kv.tags[t], k)
+			if len(kv.tags[t]) == 0 {
+				delete(kv.tags, t)
+			}
+		}
+	}
+	if next != nil {
+		for _, t := range next.Tags {
+			if kv.tags[t] == nil {
+				kv.tags[t] = make(map[string]bool)
+			}
+			kv.tags[t][k] = true
+		}
+	}
+}
+
+// Heartbeat renews the lease of peer. It returns false if the tracker
+// doesn't know peer or didn't hear from it since it started, in which case
+// peer must register its files again.
+func (kv *KV) Heartbeat(peer string) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if _, ok := kv.seen[peer]; !ok || kv.unverified[peer] {
+		return false
+	}
+	kv.seen[peer] = kv.now()
+	return true
+}
+
+// Quiet reports whether a peer wasn't seen for longer than d.
+func (kv *KV) Quiet(d time.Duration) bool {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	deadline := kv.now().Add(-d)
+	for _, t := range kv.seen {
+		if t.Before(deadline) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expire removes the peers which weren't seen for longer than lease,
+// together with the files left without peers, and returns how many peers
+// were removed.
+func (kv *KV) Expire(lease time.Duration) (int, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	deadline := kv.now().Add(-lease)
+	expired := make(map[string]bool)
+	for peer, t := range kv.seen {
+		if t.Before(deadline) {
+			expired[peer] = true
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	changes := make(map[string]*Record)
+	for k, v := range kv.data {
+		r := kv.record(k)
+		for i := len(v.Peers) - 1; i >= 0 && r != nil; i-- {
+			if expired[v.Peers[i]] {
+				r = withoutPeer(r, i)
+				changes[k] = r
+			}
+		}
+	}
+	if err := kv.store.Save(changes); err != nil {
+		return 0, err
+	}
+	for k, r := range changes {
+		kv.apply(k, r)
+	}
+	for peer := range expired {
+		delete(kv.seen, peer)
+		delete(kv.unverified, peer)
+	}
+	return len(expired), nil
+}
+
+// record returns what must be stored for k, nil if k is gone.
+func (kv *KV) record(k string) *Record {
+	v, ok := kv.data[k]
+	if !ok {
+		return nil
+	}
+	r := &Record{IFile: v.IFile, Peers: v.Peers, Added: kv.added[k]}
+	r.Metas = make(map[string]*ezt.Metadata, len(kv.metas[k]))
+	for peer, m := range kv.metas[k] {
+		r.Metas[peer] = m
+	}
+	if m, ok := kv.manifests[k]; ok {
+		r.Manifest = &m
+	}
+	return r
+}
+
+// AddManifest stores the manifest of k, the caller must verify it first.
+func (kv *KV) AddManifest(k string, m ezt.Manifest) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if r := kv.record(k); r != nil {
+		r.Manifest = &m
+		if err := kv.store.Save(map[string]*Record{k: r}); err != nil {
+			return err
+		}
+	}
+	kv.manifests[k] = m
 	return nil
 }
 
+func (kv *KV) GetManifest(k string) (ezt.Manifest, error) {
+	kv.mu.RLock()
+	m, ok := kv.manifests[k]
+	kv.mu.RUnlock()
+	if !ok {
+		return ezt.Manifest{}, fmt.Errorf("no manifest for key '%s': %w", k, ErrNotFound)
+	}
+	return m, nil
+}
+
+// Get returns the peers of k, with the unverified ones last, and when they
+// were seen.
 func (kv *KV) Get(k string) (Value, error) {
 	kv.mu.RLock()
+	defer kv.mu.RUnlock()
 	v, ok := kv.data[k]
 	if !ok {
-		return Value{}, fmt.Errorf("key '%s' does not exist", k)
+		return Value{}, fmt.Errorf("key '%s' does not exist: %w", k, ErrNotFound)
 	}
-	kv.mu.RUnlock()
+	v.LastSeen = make(map[string]time.Time, len(v.Peers))
+	for _, peer := range v.Peers {
+		v.LastSeen[peer] = kv.seen[peer]
+	}
+	if len(kv.unverified) == 0 {
+		return v, nil
+	}
+	peers := make([]string, 0, len(v.Peers))
+	for _, peer := range v.Peers {
+		if !kv.unverified[peer] {
+			peers = append(peers, peer)
+		}
+	}
+	for _, peer := range v.Peers {
+		if kv.unverified[peer] {
+			peers = append(peers, peer)
+		}
+	}
+	v.Peers = peers
 	return v, nil
 }
 
@@ -80,20 +384,10 @@ func (kv *KV) List() []Value {
 	return values
 }
 
+// GetAll returns all the files sorted by name.
 func (kv *KV) GetAll() []ezt.GetAllItem {
-	kv.mu.RLock()
-	values := make([]ezt.GetAllItem, len(kv.data))
-	i := 0
-	for k, v := range kv.data {
-		values[i] = ezt.GetAllItem{
-			Id:   k,
-			Name: v.IFile.Name,
-			Size: v.IFile.Size,
-		}
-		i++
-	}
-	kv.mu.RUnlock()
-	return values
+	rsp, _ := kv.Query(ezt.Query{})
+	return rsp.Files
 }
 
 func (kv *KV) Stat() uint64 {
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"log"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/aburdulescu/ez/cmn"
 	"github.com/aburdulescu/ez/ezt"
 )
 
@@ -24,9 +28,9 @@ func add(kv *KV, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	input := map[string]Value{
-		"1": {ezt.IFile{"a", "/a", 1}, []string{"1", "2", "3"}},
-		"2": {ezt.IFile{"b", "/b", 2}, []string{"2", "3"}},
-		"3": {ezt.IFile{"c", "/c", 3}, []string{"3"}},
+		"1": {IFile: ezt.IFile{Name: "a", Dir: "/a", Size: 1}, Peers: []string{"1", "2", "3"}},
+		"2": {IFile: ezt.IFile{Name: "b", Dir: "/b", Size: 2}, Peers: []string{"2", "3"}},
+		"3": {IFile: ezt.IFile{Name: "c", Dir: "/c", Size: 3}, Peers: []string{"3"}},
 	}
 
 	expected := make(Values, len(input))
@@ -56,9 +60,9 @@ func TestDel(t *testing.T) {
 	kv := NewKV()
 
 	input := map[string]Value{
-		"1": {ezt.IFile{"a", "/a", 1}, []string{"1", "2", "3"}},
-		"2": {ezt.IFile{"b", "/b", 2}, []string{"2", "3"}},
-		"3": {ezt.IFile{"c", "/c", 3}, []string{"3"}},
+		"1": {IFile: ezt.IFile{Name: "a", Dir: "/a", Size: 1}, Peers: []string{"1", "2", "3"}},
+		"2": {IFile: ezt.IFile{Name: "b", Dir: "/b", Size: 2}, Peers: []string{"2", "3"}},
+		"3": {IFile: ezt.IFile{Name: "c", Dir: "/c", Size: 3}, Peers: []string{"3"}},
 	}
 
 	for k, v := range input {
@@ -88,8 +92,8 @@ func del(kv *KV, wg *sync.WaitGroup) {
 	}
 
 	expected := Values{
-		{ezt.IFile{"a", "/a", 1}, []string{"1"}},
-		{ezt.IFile{"b", "/b", 2}, []string{"2"}},
+		{IFile: ezt.IFile{Name: "a", Dir: "/a", Size: 1}, Peers: []string{"1"}},
+		{IFile: ezt.IFile{Name: "b", Dir: "/b", Size: 2}, Peers: []string{"2"}},
 	}
 
 	for k, v := range input {
@@ -112,9 +116,9 @@ func TestGet(t *testing.T) {
 	kv := NewKV()
 
 	input := map[string]Value{
-		"1": {ezt.IFile{"a", "/a", 1}, []string{"1", "2", "3"}},
-		"2": {ezt.IFile{"b", "/b", 2}, []string{"2", "3"}},
-		"3": {ezt.IFile{"c", "/c", 3}, []string{"3"}},
+		"1": {IFile: ezt.IFile{Name: "a", Dir: "/a", Size: 1}, Peers: []string{"1", "2", "3"}},
+		"2": {IFile: ezt.IFile{Name: "b", Dir: "/b", Size: 2}, Peers: []string{"2", "3"}},
+		"3": {IFile: ezt.IFile{Name: "c", Dir: "/c", Size: 3}, Peers: []string{"3"}},
 	}
 
 	for k, v := range input {
@@ -139,9 +143,9 @@ func get(kv *KV, wg *sync.WaitGroup) {
 
 	input := []string{"1", "2", "3", "key not found"}
 	expected := Values{
-		{ezt.IFile{"a", "/a", 1}, []string{"1", "2", "3"}},
-		{ezt.IFile{"b", "/b", 2}, []string{"2", "3"}},
-		{ezt.IFile{"c", "/c", 3}, []string{"3"}},
+		{IFile: ezt.IFile{Name: "a", Dir: "/a", Size: 1}, Peers: []string{"1", "2", "3"}},
+		{IFile: ezt.IFile{Name: "b", Dir: "/b", Size: 2}, Peers: []string{"2", "3"}},
+		{IFile: ezt.IFile{Name: "c", Dir: "/c", Size: 3}, Peers: []string{"3"}},
 	}
 	var result Values
 	for i := range input {
@@ -194,3 +198,244 @@ func (l Peers) equals(r Peers) bool {
 	}
 	return true
 }
+
+func TestManifest(t *testing.T) {
+	kv := NewKV()
+
+	checksums := []cmn.Checksum{1, 2}
+	id := cmn.NewID(checksums)
+	m := ezt.NewManifest(cmn.ChunkSize+1, checksums)
+	f := ezt.File{Id: id, IFile: ezt.IFile{Name: "a", Dir: "/a", Size: cmn.ChunkSize + 1}, Manifest: &m}
+
+	if err := verifyManifest(f); err != nil {
+		t.Fatal(err)
+	}
+	bad := ezt.File{Id: "other", IFile: f.IFile, Manifest: &m}
+	if err := verifyManifest(bad); err == nil {
+		t.Fatal("expected manifest not to match the id")
+	}
+	short := ezt.NewManifest(cmn.ChunkSize+1, checksums[:1])
+	bad = ezt.File{Id: cmn.NewID(checksums[:1]), IFile: f.IFile, Manifest: &short}
+	if err := verifyManifest(bad); err == nil {
+		t.Fatal("expected manifest with missing checksums to be rejected")
+	}
+
+	kv.Add(f.Id, f.IFile, "1")
+	kv.AddManifest(f.Id, m)
+	if _, err := kv.GetManifest(f.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Del(f.Id, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.GetManifest(f.Id); err == nil {
+		t.Fatal("manifest was not removed with the last peer")
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := OpenKV(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksums := []cmn.Checksum{1}
+	m := ezt.NewManifest(1, checksums)
+	a := ezt.File{Id: cmn.NewID(checksums), IFile: ezt.IFile{Name: "a", Dir: "/a", Size: 1}, Manifest: &m}
+	b := ezt.File{Id: "2", IFile: ezt.IFile{Name: "b", Dir: "/b", Size: 2}}
+	if err := kv.AddFiles("1", []ezt.File{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.AddFiles("2", []ezt.File{a}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.AddFiles("3", []ezt.File{b}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Del(b.Id, "3"); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	kv, err = OpenKV(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(time.Minute)
+	kv.now = func() time.Time { return now }
+
+	t.Run("Reload", func(t *testing.T) {
+		expected := Values{
+			{IFile: a.IFile, Peers: []string{"1", "2"}},
+			{IFile: b.IFile, Peers: []string{"1"}},
+		}
+		if result := Values(kv.List()); !result.equals(expected) {
+			t.Fatal("expected", expected, "got", result)
+		}
+		if _, err := kv.GetManifest(a.Id); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		if kv.Heartbeat("2") {
+			t.Fatal("heartbeat of unverified peer was accepted")
+		}
+		if err := kv.AddFiles("2", []ezt.File{a}); err != nil {
+			t.Fatal(err)
+		}
+		if !kv.Heartbeat("2") {
+			t.Fatal("heartbeat of verified peer was rejected")
+		}
+		v, err := kv.Get(a.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Peers(v.Peers).equals(Peers{"2", "1"}) {
+			t.Fatal("unverified peers must be last, got", v.Peers)
+		}
+		if !v.LastSeen["2"].Equal(now) || !v.LastSeen["1"].Before(now) {
+			t.Fatal("unexpected last seen:", v.LastSeen)
+		}
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		n, err := kv.Expire(30 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatal("expected 1 expired peer, got", n)
+		}
+		expected := Values{{IFile: a.IFile, Peers: []string{"2"}}}
+		if result := Values(kv.List()); !result.equals(expected) {
+			t.Fatal("expected", expected, "got", result)
+		}
+		if _, err := kv.GetManifest(b.Id); err == nil {
+			t.Fatal("file without peers was not removed")
+		}
+		records, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || !Peers(records[a.Id].Peers).equals(Peers{"2"}) || records[a.Id].Manifest == nil {
+			t.Fatal("unexpected records:", records)
+		}
+	})
+}
+
+func TestHeartbeat(t *testing.T) {
+	kv := NewKV()
+	now := time.Now()
+	kv.now = func() time.Time { return now }
+
+	if kv.Heartbeat("1") {
+		t.Fatal("heartbeat of unknown peer was accepted")
+	}
+	kv.Add("1", ezt.IFile{Name: "a", Dir: "/a", Size: 1}, "1")
+	kv.Add("1", ezt.IFile{Name: "a", Dir: "/a", Size: 1}, "2")
+	kv.Add("2", ezt.IFile{Name: "b", Dir: "/b", Size: 2}, "2")
+
+	now = now.Add(time.Minute)
+	if !kv.Heartbeat("1") {
+		t.Fatal("heartbeat of known peer was rejected")
+	}
+	if !kv.Quiet(30 * time.Second) {
+		t.Fatal("peer 2 is quiet")
+	}
+	n, err := kv.Expire(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatal("expected 1 expired peer, got", n)
+	}
+	expected := Values{{IFile: ezt.IFile{Name: "a", Dir: "/a", Size: 1}, Peers: []string{"1"}}}
+	if result := Values(kv.List()); !result.equals(expected) {
+		t.Fatal("expected", expected, "got", result)
+	}
+	if kv.Heartbeat("2") {
+		t.Fatal("heartbeat of expired peer was accepted")
+	}
+	if kv.Quiet(30 * time.Second) {
+		t.Fatal("no peer is quiet")
+	}
+}
+
+// failingStore fails to save when fail is set.
+type failingStore struct {
+	nopStore
+	fail bool
+}
+
+func (s *failingStore) Save(records map[string]*Record) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+// TestStoreFailure checks that the changes which couldn't be saved are not
+// kept in memory either.
+func TestStoreFailure(t *testing.T) {
+	store := &failingStore{}
+	kv, err := OpenKV(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	kv.now = func() time.Time { return now }
+	a := ezt.IFile{Name: "a", Dir: "/a", Size: 1, Meta: &ezt.Metadata{Tags: []string{"x"}}}
+	if err := kv.Add("1", a, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Add("1", a, "2"); err != nil {
+		t.Fatal(err)
+	}
+	expected := Values{{IFile: a, Peers: []string{"1", "2"}}}
+
+	store.fail = true
+	now = now.Add(time.Minute)
+	b := ezt.IFile{Name: "b", Dir: "/b", Size: 2}
+	if err := kv.AddFiles("3", []ezt.File{{Id: "2", IFile: b}, {Id: "1", IFile: a}}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := kv.Del("1", "1"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := kv.Expire(30 * time.Second); err == nil {
+		t.Fatal("expected an error")
+	}
+	if result := Values(kv.List()); !result.equals(expected) {
+		t.Fatal("expected", expected, "got", result)
+	}
+	if kv.Heartbeat("3") {
+		t.Fatal("heartbeat of a peer which wasn't saved was accepted")
+	}
+	rsp, err := kv.Query(ezt.Query{Tags: []string{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Files) != 1 {
+		t.Fatal("unexpected files:", rsp.Files)
+	}
+
+	store.fail = false
+	n, err := kv.Expire(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(kv.List()) != 0 {
+		t.Fatal("expected 2 expired peers and no files, got", n, kv.List())
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/aburdulescu/ez/ezt"
@@ -18,11 +22,92 @@ type Server struct {
 	c *KV
 }
 
+var dbPath string
+var lease time.Duration
+
 func main() {
-	s := Server{NewKV()}
-	http.HandleFunc("/", s.handleRequest)
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	flag.StringVar(&dbPath, "dbpath", "./tracker.db", "path where the database is stored, empty to keep everything in memory")
+	flag.DurationVar(&lease, "lease", 90*time.Second, "remove the peers which don't send a heartbeat or register again for this long, 0 to keep them")
+	flag.Parse()
+
+	if lease < 0 || (lease != 0 && lease < time.Second) {
+		return fmt.Errorf("lease must be 0 or at least 1s")
+	}
+
+	var store Store = nopStore{}
+	if dbPath != "" {
+		db, err := NewBoltStore(dbPath)
+		if err != nil {
+			return err
+		}
+		store = db
+	}
+	kv, err := OpenKV(store)
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	s := Server{kv}
+	s.register(http.DefaultServeMux)
 	go sendProbeToSeeders()
-	log.Fatal(http.ListenAndServe(":22200", nil))
+	if lease != 0 {
+		go s.expirePeers(lease)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- http.ListenAndServe(":22200", nil)
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err = <-errc:
+	case <-c:
+	}
+	store.Close()
+	return err
+}
+
+// expirePeers removes the peers whose lease lapsed. Seeders which don't
+// send heartbeats are probed when a peer is quiet for half of its lease, so
+// they can renew it by registering again.
+func (s Server) expirePeers(lease time.Duration) {
+	interval := lease / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		n, err := s.c.Expire(lease)
+		if err != nil {
+			log.Println(err)
+		}
+		if n != 0 {
+			log.Println("expired", n, "peers")
+		}
+		if s.c.Quiet(lease / 2) {
+			go sendProbeToSeeders()
+		}
+	}
+}
+
+// register adds the handlers of the legacy and v1 APIs to mux.
+func (s Server) register(mux *http.ServeMux) {
+	mux.HandleFunc("/", s.handleRequest)
+	mux.HandleFunc("/manifest", s.handleManifest)
+	mux.HandleFunc("/heartbeat", s.handleHeartbeat)
+	mux.HandleFunc("/v1/files", s.handleV1Files)
+	mux.HandleFunc("/v1/files/", s.handleV1File)
+	mux.HandleFunc("/v1/heartbeat", s.handleV1Heartbeat)
 }
 
 func sendProbeToSeeders() {
@@ -69,7 +154,7 @@ func (s Server) handleGet(w http.ResponseWriter, r *http.Request) (int, error) {
 	} else {
 		v, err := s.c.Get(id)
 		if err != nil {
-			return http.StatusInternalServerError, err
+			return statusOf(err), err
 		}
 		respond(w, &v)
 	}
@@ -83,12 +168,111 @@ func (s Server) handlePost(w http.ResponseWriter, r *http.Request) (int, error)
 		return http.StatusBadRequest, fmt.Errorf("could not decode body: %v", err.Error())
 	}
 	log.Println("post data:", req)
-	for i := range req.Files {
-		s.c.Add(req.Files[i].Id, req.Files[i].IFile, req.Addr)
+	return s.addFiles(req)
+}
+
+// addFiles registers the files of req. The whole request is rejected if any
+// file has an invalid manifest or tags, files which conflict with the known
+// ones are skipped.
+func (s Server) addFiles(req ezt.AddRequest) (int, error) {
+	if req.Addr == "" {
+		return http.StatusBadRequest, errors.New("missing 'addr'")
+	}
+	var invalid []string
+	files := make([]ezt.File, 0, len(req.Files))
+	for _, f := range req.Files {
+		if f.Manifest != nil {
+			if err := verifyManifest(f); err != nil {
+				log.Println(err)
+				invalid = append(invalid, f.Id)
+				continue
+			}
+		}
+		if f.IFile.Meta != nil {
+			meta := *f.IFile.Meta
+			tags, err := ezt.NormalizeTags(meta.Tags)
+			if err != nil {
+				log.Println(err)
+				invalid = append(invalid, f.Id)
+				continue
+			}
+			meta.Tags = tags
+			f.IFile.Meta = &meta
+		}
+		files = append(files, f)
+	}
+	if len(invalid) != 0 {
+		return http.StatusBadRequest, fmt.Errorf("invalid manifests or tags for: %v", invalid)
+	}
+	if err := s.c.AddFiles(req.Addr, files); err != nil {
+		log.Println(err)
+		return statusOf(err), err
 	}
 	return http.StatusOK, nil
 }
 
+// statusOf returns the HTTP status for an error of the KV.
+func statusOf(err error) int {
+	var conflict *ConflictError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &conflict):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func verifyManifest(f ezt.File) error {
+	if err := f.Manifest.Verify(f.Id); err != nil {
+		return err
+	}
+	if f.Manifest.Size != f.IFile.Size {
+		return fmt.Errorf("manifest size doesn't match the size of '%s'", f.Id)
+	}
+	return nil
+}
+
+func (s Server) handleManifest(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	defer r.Body.Close()
+	if r.Method != "GET" {
+		http.Error(w, "unknown HTTP method", http.StatusBadRequest)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing 'id' parameter", http.StatusBadRequest)
+		return
+	}
+	m, err := s.c.GetManifest(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	respond(w, &m)
+}
+
+func (s Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != "POST" {
+		http.Error(w, "unknown HTTP method", http.StatusBadRequest)
+		return
+	}
+	var req ezt.HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("could not decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !s.c.Heartbeat(req.Addr) {
+		http.Error(w, fmt.Sprintf("peer '%s' must register again", req.Addr), http.StatusNotFound)
+		return
+	}
+	rsp := ezt.HeartbeatResponse{Lease: int64(lease / time.Second)}
+	respond(w, &rsp)
+}
+
 func (s Server) handleDelete(w http.ResponseWriter, r *http.Request) (int, error) {
 	defer r.Body.Close()
 	id := r.URL.Query().Get("id")
@@ -96,11 +280,11 @@ func (s Server) handleDelete(w http.ResponseWriter, r *http.Request) (int, error
 		return http.StatusBadRequest, errors.New("missing 'id' parameter")
 	}
 	addr := r.URL.Query().Get("addr")
-	if id == "" {
+	if addr == "" {
 		return http.StatusBadRequest, errors.New("missing 'addr' parameter")
 	}
 	if err := s.c.Del(id, addr); err != nil {
-		return http.StatusInternalServerError, err
+		return statusOf(err), err
 	}
 	return http.StatusOK, nil
 }
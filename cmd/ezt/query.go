@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aburdulescu/ez/ezt"
+)
+
+// Query returns the files selected by q, which must be valid, in its order.
+func (kv *KV) Query(q ezt.Query) (ezt.GetAllResponse, error) {
+	match, err := matcher(q)
+	if err != nil {
+		return ezt.GetAllResponse{}, err
+	}
+	key := q.Sort
+	if key == "" {
+		key = ezt.SortName
+	}
+	less := lessFunc(key)
+
+	tags, err := ezt.NormalizeTags(q.Tags)
+	if err != nil {
+		return ezt.GetAllResponse{}, err
+	}
+
+	kv.mu.RLock()
+	files := make([]ezt.GetAllItem, 0, len(kv.data))
+	add := func(k string, v Value) {
+		if !v.IFile.Meta.HasTags(tags) {
+			return
+		}
+		item := ezt.GetAllItem{
+			Id:    k,
+			Name:  v.IFile.Name,
+			Size:  v.IFile.Size,
+			Peers: len(v.Peers),
+			Added: kv.added[k],
+		}
+		if v.IFile.Meta != nil {
+			item.Tags = v.IFile.Meta.Tags
+			item.Desc = v.IFile.Meta.Desc
+		}
+		if match(item) {
+			files = append(files, item)
+		}
+	}
+	if len(tags) == 0 {
+		for k, v := range kv.data {
+			add(k, v)
+		}
+	} else {
+		// only the keys of the rarest tag can match
+		keys := kv.tags[tags[0]]
+		for _, t := range tags[1:] {
+			if len(kv.tags[t]) < len(keys) {
+				keys = kv.tags[t]
+			}
+		}
+		for k := range keys {
+			add(k, kv.data[k])
+		}
+	}
+	kv.mu.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		return less(files[i], files[j])
+	})
+	if q.Cursor != "" {
+		c, err := ezt.DecodeCursor(q.Cursor)
+		if err != nil {
+			return ezt.GetAllResponse{}, err
+		}
+		if c.Sort != key {
+			return ezt.GetAllResponse{}, fmt.Errorf("cursor was made for sort '%s'", c.Sort)
+		}
+		i := sort.Search(len(files), func(i int) bool {
+			return less(c.Last, files[i])
+		})
+		files = files[i:]
+	}
+	rsp := ezt.GetAllResponse{Files: files}
+	if q.Limit != 0 && len(files) > q.Limit {
+		rsp.Files = files[:q.Limit]
+		rsp.Next = ezt.Cursor{Sort: key, Last: rsp.Files[q.Limit-1]}.Encode()
+	}
+	return rsp, nil
+}
+
+func matcher(q ezt.Query) (func(ezt.GetAllItem) bool, error) {
+	name := strings.ToLower(q.Name)
+	var re *regexp.Regexp
+	if q.Regex != "" {
+		var err error
+		if re, err = regexp.Compile(q.Regex); err != nil {
+			return nil, err
+		}
+	}
+	return func(f ezt.GetAllItem) bool {
+		if name != "" && !strings.Contains(strings.ToLower(f.Name), name) {
+			return false
+		}
+		if q.Glob != "" {
+			if ok, _ := path.Match(q.Glob, f.Name); !ok {
+				return false
+			}
+		}
+		if re != nil && !re.MatchString(f.Name) {
+			return false
+		}
+		if f.Size < q.MinSize || (q.MaxSize != 0 && f.Size > q.MaxSize) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+// lessFunc returns the order of key, files with equal keys are ordered by id.
+func lessFunc(key string) func(a, b ezt.GetAllItem) bool {
+	desc := strings.HasPrefix(key, "-")
+	var cmp func(a, b ezt.GetAllItem) int
+	switch strings.TrimPrefix(key, "-") {
+	case ezt.SortSize:
+		cmp = func(a, b ezt.GetAllItem) int { return compare(a.Size, b.Size) }
+	case ezt.SortPeers:
+		cmp = func(a, b ezt.GetAllItem) int { return compare(int64(a.Peers), int64(b.Peers)) }
+	case ezt.SortAdded:
+		cmp = func(a, b ezt.GetAllItem) int { return compare(a.Added.UnixNano(), b.Added.UnixNano()) }
+	default:
+		cmp = func(a, b ezt.GetAllItem) int { return strings.Compare(a.Name, b.Name) }
+	}
+	return func(a, b ezt.GetAllItem) bool {
+		c := cmp(a, b)
+		if desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+		return a.Id < b.Id
+	}
+}
+
+func compare(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aburdulescu/ez/ezt"
+)
+
+func TestQuery(t *testing.T) {
+	kv := NewKV()
+	now := time.Now()
+	kv.now = func() time.Time { return now }
+	files := []struct {
+		id    string
+		name  string
+		size  int64
+		peers []string
+	}{
+		{"1", "nightly-2.img", 300, []string{"a"}},
+		{"2", "dataset.csv", 100, []string{"a", "b"}},
+		{"3", "Nightly-1.img", 200, []string{"a", "b", "c"}},
+		{"4", "notes.txt", 100, []string{"c"}},
+		{"5", "dataset.csv", 50, []string{"b"}},
+	}
+	for _, f := range files {
+		now = now.Add(time.Second)
+		for _, peer := range f.peers {
+			kv.Add(f.id, ezt.IFile{Name: f.name, Size: f.size}, peer)
+		}
+	}
+
+	ids := func(files []ezt.GetAllItem) []string {
+		var ids []string
+		for _, f := range files {
+			ids = append(ids, f.Id)
+		}
+		return ids
+	}
+	tests := []struct {
+		name     string
+		q        ezt.Query
+		expected []string
+	}{
+		{"All", ezt.Query{}, []string{"3", "2", "5", "1", "4"}},
+		{"Name", ezt.Query{Name: "NIGHTLY"}, []string{"3", "1"}},
+		{"Glob", ezt.Query{Glob: "*.csv"}, []string{"2", "5"}},
+		{"Regex", ezt.Query{Regex: `^n.*\.(img|txt)$`}, []string{"1", "4"}},
+		{"Size", ezt.Query{MinSize: 100, MaxSize: 200}, []string{"3", "2", "4"}},
+		{"SortSize", ezt.Query{Sort: "size"}, []string{"5", "2", "4", "3", "1"}},
+		{"SortSizeDesc", ezt.Query{Sort: "-size"}, []string{"1", "3", "2", "4", "5"}},
+		{"SortPeers", ezt.Query{Sort: "-peers"}, []string{"3", "2", "1", "4", "5"}},
+		{"SortAdded", ezt.Query{Sort: "added"}, []string{"1", "2", "3", "4", "5"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.q.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			rsp, err := kv.Query(test.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result := ids(rsp.Files); !Peers(result).equals(test.expected) || rsp.Next != "" {
+				t.Fatal("expected", test.expected, "got", result, rsp.Next)
+			}
+		})
+	}
+
+	t.Run("Pages", func(t *testing.T) {
+		q := ezt.Query{Sort: "-size", Limit: 2}
+		var result []string
+		for i := 0; ; i++ {
+			rsp, err := kv.Query(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, ids(rsp.Files)...)
+			if rsp.Next == "" {
+				break
+			}
+			if i == 0 {
+				// a file added between pages doesn't shift the next ones
+				kv.Add("6", ezt.IFile{Name: "new", Size: 1000}, "a")
+			}
+			q.Cursor = rsp.Next
+		}
+		expected := []string{"1", "3", "2", "4", "5"}
+		if !Peers(result).equals(expected) {
+			t.Fatal("expected", expected, "got", result)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		rsp, err := kv.Query(ezt.Query{Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		invalid := []ezt.Query{
+			{Regex: "("},
+			{Glob: "["},
+			{Sort: "date"},
+			{MinSize: 2, MaxSize: 1},
+			{Limit: -1},
+			{Cursor: "garbage"},
+		}
+		for _, q := range invalid {
+			if err := q.Validate(); err == nil {
+				t.Fatal("query was accepted:", q)
+			}
+		}
+		if _, err := kv.Query(ezt.Query{Sort: "size", Cursor: rsp.Next}); err == nil {
+			t.Fatal("cursor of another sort was accepted")
+		}
+	})
+}
+
+func TestTags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { store.Close() }()
+	kv, err := OpenKV(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := func(desc string, tags ...string) *ezt.Metadata {
+		return &ezt.Metadata{Tags: tags, Desc: desc}
+	}
+	add := func(id, peer string, m *ezt.Metadata) {
+		if err := kv.Add(id, ezt.IFile{Name: id, Size: 1, Meta: m}, peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("1", "a", meta("nightly image", "build", "vm"))
+	add("1", "b", meta("", "nightly"))
+	add("2", "a", meta("dataset", "data"))
+	add("3", "a", nil)
+	add("4", "c", meta("", "build"))
+
+	tagged := func(t *testing.T, tags ...string) []string {
+		rsp, err := kv.Query(ezt.Query{Tags: tags})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, f := range rsp.Files {
+			ids = append(ids, f.Id)
+		}
+		return ids
+	}
+
+	t.Run("Filter", func(t *testing.T) {
+		if ids := tagged(t, "build"); !Peers(ids).equals(Peers{"1", "4"}) {
+			t.Fatal("unexpected files:", ids)
+		}
+		if ids := tagged(t, "BUILD", "nightly"); !Peers(ids).equals(Peers{"1"}) {
+			t.Fatal("unexpected files:", ids)
+		}
+		if ids := tagged(t, "build", "data"); len(ids) != 0 {
+			t.Fatal("unexpected files:", ids)
+		}
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		v, err := kv.Get("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Peers(v.IFile.Meta.Tags).equals(Peers{"build", "nightly", "vm"}) || v.IFile.Meta.Desc != "nightly image" {
+			t.Fatal("unexpected metadata:", v.IFile.Meta)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		if err := kv.Del("4", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if ids := tagged(t, "build"); !Peers(ids).equals(Peers{"1"}) {
+			t.Fatal("unexpected files:", ids)
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		store.Close()
+		if store, err = NewBoltStore(path); err != nil {
+			t.Fatal(err)
+		}
+		if kv, err = OpenKV(store); err != nil {
+			t.Fatal(err)
+		}
+		if ids := tagged(t, "nightly"); !Peers(ids).equals(Peers{"1"}) {
+			t.Fatal("unexpected files:", ids)
+		}
+		if ids := tagged(t, "data"); !Peers(ids).equals(Peers{"2"}) {
+			t.Fatal("unexpected files:", ids)
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		// b doesn't tag 1 with nightly anymore, a still tags it with build
+		add("1", "b", meta("", "weekly"))
+		check := func(t *testing.T) {
+			if ids := tagged(t, "nightly"); len(ids) != 0 {
+				t.Fatal("unexpected files:", ids)
+			}
+			if ids := tagged(t, "weekly", "build"); !Peers(ids).equals(Peers{"1"}) {
+				t.Fatal("unexpected files:", ids)
+			}
+		}
+		check(t)
+		store.Close()
+		if store, err = NewBoltStore(path); err != nil {
+			t.Fatal(err)
+		}
+		if kv, err = OpenKV(store); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		if err := kv.Del("1", "b"); err != nil {
+			t.Fatal(err)
+		}
+		if ids := tagged(t, "weekly"); len(ids) != 0 {
+			t.Fatal("unexpected files:", ids)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aburdulescu/ez/ezt"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Record is what the tracker knows about a file.
+type Record struct {
+	IFile    ezt.IFile     `json:"ifile"`
+	Peers    []string      `json:"peers"`
+	Manifest *ezt.Manifest `json:"manifest,omitempty"`
+	Added    time.Time     `json:"added"`
+	// Metas holds the metadata sent by each peer, IFile has their merge.
+	Metas map[string]*ezt.Metadata `json:"metas,omitempty"`
+}
+
+// Store keeps the records of the KV across restarts.
+type Store interface {
+	// Load returns all the stored records by id.
+	Load() (map[string]Record, error)
+	// Save writes the records at once, a nil record deletes its id.
+	Save(records map[string]*Record) error
+	Close() error
+}
+
+// nopStore is used when the tracker runs without a database.
+type nopStore struct{}
+
+func (nopStore) Load() (map[string]Record, error)      { return nil, nil }
+func (nopStore) Save(records map[string]*Record) error { return nil }
+func (nopStore) Close() error                          { return nil }
+
+var FilesBucket = []byte("files")
+
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(FilesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db}, nil
+}
+
+func (s BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s BoltStore) Load() (map[string]Record, error) {
+	records := make(map[string]Record)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(FilesBucket).ForEach(func(k, v []byte) error {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			records[string(k)] = r
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s BoltStore) Save(records map[string]*Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	values := make(map[string][]byte, len(records))
+	for k, r := range records {
+		if r == nil {
+			continue
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		values[k] = b
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(FilesBucket)
+		for k, r := range records {
+			if r == nil {
+				if err := b.Delete([]byte(k)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := b.Put([]byte(k), values[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
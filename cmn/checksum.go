@@ -11,3 +11,21 @@ const ChecksumSize = 8
 func NewChecksum(data []byte) Checksum {
 	return Checksum(xxh.Sum64(data))
 }
+
+// Digest computes a Checksum incrementally, for data which is not available
+// all at once.
+type Digest struct {
+	d *xxh.Digest
+}
+
+func NewDigest() Digest {
+	return Digest{xxh.New()}
+}
+
+func (d Digest) Write(b []byte) (int, error) {
+	return d.d.Write(b)
+}
+
+func (d Digest) Sum() Checksum {
+	return Checksum(d.d.Sum64())
+}
@@ -0,0 +1,20 @@
+package cmn
+
+import "strings"
+
+// Strings is a flag.Value which collects the values of a repeated flag, a
+// value can also hold more of them separated by commas.
+type Strings []string
+
+func (s *Strings) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *Strings) Set(v string) error {
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			*s = append(*s, e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package cmn
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+const IdAlg = "sha256"
+
+// NewID returns the id of a file, computed from the checksums of its chunks.
+func NewID(checksums []Checksum) string {
+	h := sha256.New()
+	b := make([]byte, ChecksumSize)
+	for i := range checksums {
+		binary.BigEndian.PutUint64(b, uint64(checksums[i]))
+		h.Write(b)
+	}
+	digest := h.Sum(nil)
+	id := IdAlg + "-" + hex.EncodeToString(digest)
+	return id
+}
@@ -2,6 +2,7 @@ package cmn
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"text/tabwriter"
 )
@@ -11,7 +12,11 @@ type Printer struct {
 }
 
 func NewPrinter() Printer {
-	return Printer{tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)}
+	return NewPrinterWithWriter(os.Stdout)
+}
+
+func NewPrinterWithWriter(w io.Writer) Printer {
+	return Printer{tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)}
 }
 
 func (p Printer) Printf(format string, args ...interface{}) {
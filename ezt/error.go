@@ -0,0 +1,57 @@
+package ezt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var (
+	ErrBadRequest = errors.New("bad request")
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+)
+
+// Error is an error sent by the tracker, it wraps ErrBadRequest,
+// ErrNotFound or ErrConflict for the matching statuses.
+type Error struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tracker: %s", e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	switch e.Status {
+	case http.StatusBadRequest:
+		return ErrBadRequest
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	default:
+		return nil
+	}
+}
+
+// checkResponse returns an *Error if rsp doesn't have a 2xx status.
+func checkResponse(rsp *http.Response) error {
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(rsp.Body, 64<<10))
+	var r ErrorResponse
+	if err := json.Unmarshal(b, &r); err != nil || r.Error.Message == "" {
+		return &Error{Status: rsp.StatusCode, Message: rsp.Status}
+	}
+	r.Error.Status = rsp.StatusCode
+	return &r.Error
+}
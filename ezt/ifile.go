@@ -2,14 +2,94 @@ package ezt
 
 import (
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
+// MAX_TAG_LEN is the max length of a tag.
+const MAX_TAG_LEN = 64
+
 type IFile struct {
-	Name string `json:"name"`
-	Dir  string `json:"dir"`
-	Size int64  `json:"size"`
+	Name string    `json:"name"`
+	Dir  string    `json:"dir"`
+	Size int64     `json:"size"`
+	Meta *Metadata `json:"meta,omitempty"`
+}
+
+// Metadata describes what a file is, beyond its name.
+type Metadata struct {
+	Tags     []string  `json:"tags,omitempty"`
+	Desc     string    `json:"desc,omitempty"`
+	ModTime  time.Time `json:"mtime"`
+	MimeType string    `json:"mime,omitempty"`
+}
+
+// NormalizeTags returns the tags in lower case, sorted and without
+// duplicates, or an error if one of them is empty, too long or has spaces.
+func NormalizeTags(tags []string) ([]string, error) {
+	var r []string
+	for _, t := range tags {
+		t = strings.ToLower(t)
+		if t == "" || len(t) > MAX_TAG_LEN || strings.ContainsAny(t, " \t\n,") {
+			return nil, fmt.Errorf("invalid tag '%s'", t)
+		}
+		r = append(r, t)
+	}
+	sort.Strings(r)
+	n := 0
+	for i := range r {
+		if i == 0 || r[i] != r[n-1] {
+			r[n] = r[i]
+			n++
+		}
+	}
+	return r[:n], nil
+}
+
+// Merge returns the metadata of a file shared with m by more peers, i.e.
+// the tags of both and the other values of r where it has them.
+func (m *Metadata) Merge(r *Metadata) *Metadata {
+	if m == nil {
+		return r
+	}
+	if r == nil {
+		return m
+	}
+	merged := *r
+	merged.Tags, _ = NormalizeTags(append(append([]string(nil), m.Tags...), r.Tags...))
+	if merged.Desc == "" {
+		merged.Desc = m.Desc
+	}
+	if merged.ModTime.IsZero() {
+		merged.ModTime = m.ModTime
+	}
+	if merged.MimeType == "" {
+		merged.MimeType = m.MimeType
+	}
+	return &merged
+}
+
+// HasTags reports whether m has all tags, which must be normalized.
+func (m *Metadata) HasTags(tags []string) bool {
+	for _, t := range tags {
+		if m == nil || findTag(m.Tags, t) == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+func findTag(tags []string, t string) int {
+	i := sort.SearchStrings(tags, t)
+	if i == len(tags) || tags[i] != t {
+		return -1
+	}
+	return i
 }
 
 func NewIFile(f *os.File, path string) (IFile, error) {
@@ -30,14 +110,32 @@ func NewIFile(f *os.File, path string) (IFile, error) {
 		}
 		abspath = filepath.Join(pwd, filepath.Dir(path))
 	}
+	mimeType, err := detectMimeType(f)
+	if err != nil {
+		return IFile{}, err
+	}
 	ifile := IFile{
 		Name: fi.Name(),
 		Size: fi.Size(),
 		Dir:  abspath,
+		Meta: &Metadata{
+			ModTime:  fi.ModTime().UTC(),
+			MimeType: mimeType,
+		},
 	}
 	return ifile, nil
 }
 
+// detectMimeType returns the MIME type of the content of f.
+func detectMimeType(f *os.File) (string, error) {
+	b := make([]byte, 512)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(b[:n]), nil
+}
+
 func (l IFile) Equals(r IFile) bool {
 	return (l.Name == r.Name && l.Size == r.Size && l.Dir == r.Dir)
 }
@@ -0,0 +1,49 @@
+package ezt
+
+import (
+	"fmt"
+
+	"github.com/aburdulescu/ez/cmn"
+)
+
+// Manifest describes how a file is split in chunks. The id of the file is
+// computed from the chunk checksums, so a manifest can be checked against
+// the id without trusting whoever sent it.
+type Manifest struct {
+	IdAlg     string         `json:"id_alg"`
+	Size      int64          `json:"size"`
+	ChunkSize int64          `json:"chunk_size"`
+	PieceSize int64          `json:"piece_size"`
+	Checksums []cmn.Checksum `json:"checksums"`
+}
+
+func NewManifest(size int64, checksums []cmn.Checksum) Manifest {
+	return Manifest{
+		IdAlg:     cmn.IdAlg,
+		Size:      size,
+		ChunkSize: cmn.ChunkSize,
+		PieceSize: cmn.PieceSize,
+		Checksums: checksums,
+	}
+}
+
+// Verify returns an error if the manifest doesn't match the given id.
+func (m Manifest) Verify(id string) error {
+	if m.IdAlg != cmn.IdAlg {
+		return fmt.Errorf("unsupported id algorithm '%s'", m.IdAlg)
+	}
+	if m.ChunkSize <= 0 || m.Size < 0 {
+		return fmt.Errorf("invalid manifest sizes")
+	}
+	nchunks := m.Size / m.ChunkSize
+	if m.Size%m.ChunkSize != 0 {
+		nchunks++
+	}
+	if int64(len(m.Checksums)) != nchunks {
+		return fmt.Errorf("manifest has %d checksums, expected %d", len(m.Checksums), nchunks)
+	}
+	if cmn.NewID(m.Checksums) != id {
+		return fmt.Errorf("manifest doesn't match id '%s'", id)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package ezt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Sort keys of a Query, prefixed with - for descending order.
+const (
+	SortName  = "name"
+	SortSize  = "size"
+	SortPeers = "peers"
+	SortAdded = "added"
+)
+
+// Query selects and orders the files listed by the tracker. Files with the
+// same sort key are ordered by id, so the order is stable.
+type Query struct {
+	// Name matches the files whose name contains it, ignoring case.
+	Name string
+	// Glob matches the names with path.Match.
+	Glob string
+	// Regex matches the names with regexp.
+	Regex string
+	// Tags matches the files which have all of them.
+	Tags []string
+	// MinSize and MaxSize bound the size of the files, 0 for no bound.
+	MinSize int64
+	MaxSize int64
+	// Sort is the sort key, SortName if empty.
+	Sort string
+	// Limit is the max number of files returned, 0 for all.
+	Limit int
+	// Cursor is the Next of the previous page.
+	Cursor string
+}
+
+// Values encodes q as URL query parameters.
+func (q Query) Values() url.Values {
+	v := url.Values{}
+	set := func(k, s string) {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	set("name", q.Name)
+	set("glob", q.Glob)
+	set("regex", q.Regex)
+	for _, t := range q.Tags {
+		v.Add("tag", t)
+	}
+	if q.MinSize != 0 {
+		v.Set("min_size", strconv.FormatInt(q.MinSize, 10))
+	}
+	if q.MaxSize != 0 {
+		v.Set("max_size", strconv.FormatInt(q.MaxSize, 10))
+	}
+	set("sort", q.Sort)
+	if q.Limit != 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	set("cursor", q.Cursor)
+	return v
+}
+
+// ParseQuery decodes and validates the query parameters made by Values.
+func ParseQuery(v url.Values) (Query, error) {
+	q := Query{
+		Name:   v.Get("name"),
+		Glob:   v.Get("glob"),
+		Regex:  v.Get("regex"),
+		Tags:   v["tag"],
+		Sort:   v.Get("sort"),
+		Cursor: v.Get("cursor"),
+	}
+	var err error
+	if s := v.Get("min_size"); s != "" {
+		if q.MinSize, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return Query{}, fmt.Errorf("invalid 'min_size': %v", err)
+		}
+	}
+	if s := v.Get("max_size"); s != "" {
+		if q.MaxSize, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return Query{}, fmt.Errorf("invalid 'max_size': %v", err)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil {
+			return Query{}, fmt.Errorf("invalid 'limit': %v", err)
+		}
+	}
+	return q, q.Validate()
+}
+
+// Validate checks the values of q which can be wrong.
+func (q Query) Validate() error {
+	if q.MinSize < 0 || q.MaxSize < 0 || q.Limit < 0 {
+		return fmt.Errorf("sizes and limit can't be negative")
+	}
+	if q.MaxSize != 0 && q.MinSize > q.MaxSize {
+		return fmt.Errorf("min size is greater than max size")
+	}
+	if _, err := path.Match(q.Glob, ""); err != nil {
+		return fmt.Errorf("invalid glob: %v", err)
+	}
+	if _, err := regexp.Compile(q.Regex); err != nil {
+		return fmt.Errorf("invalid regex: %v", err)
+	}
+	if _, err := NormalizeTags(q.Tags); err != nil {
+		return err
+	}
+	switch strings.TrimPrefix(q.Sort, "-") {
+	case "", SortName, SortSize, SortPeers, SortAdded:
+	default:
+		return fmt.Errorf("unknown sort key '%s'", q.Sort)
+	}
+	if q.Cursor != "" {
+		if _, err := DecodeCursor(q.Cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cursor is the position of a page, i.e. the last file of the previous one
+// and the sort it was in.
+type Cursor struct {
+	Sort string     `json:"sort"`
+	Last GetAllItem `json:"last"`
+}
+
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(&c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor")
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
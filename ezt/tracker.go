@@ -3,13 +3,23 @@ package ezt
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
+// ErrUnknownPeer is returned by Heartbeat when the peer must register its
+// files again.
+var ErrUnknownPeer = errors.New("tracker doesn't know the peer")
+
 type File struct {
-	Id    string `json:"id"`
-	IFile IFile  `json:"ifile"`
+	Id       string    `json:"id"`
+	IFile    IFile     `json:"ifile"`
+	Manifest *Manifest `json:"manifest,omitempty"`
 }
 
 type AddRequest struct {
@@ -23,13 +33,19 @@ type RemoveRequest struct {
 }
 
 type GetAllItem struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
-	Size int64  `json:"size"`
+	Id    string    `json:"id"`
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	Peers int       `json:"peers"`
+	Added time.Time `json:"added"`
+	Tags  []string  `json:"tags,omitempty"`
+	Desc  string    `json:"desc,omitempty"`
 }
 
 type GetAllResponse struct {
 	Files []GetAllItem `json:"files"`
+	// Next is the cursor of the next page, empty on the last one.
+	Next string `json:"next,omitempty"`
 }
 
 type GetRequest struct {
@@ -37,72 +53,141 @@ type GetRequest struct {
 }
 
 type GetResponse struct {
-	IFile IFile    `json:"ifile"`
-	Peers []string `json:"peers"`
+	IFile    IFile                `json:"ifile"`
+	Peers    []string             `json:"peers"`
+	LastSeen map[string]time.Time `json:"last_seen,omitempty"`
+}
+
+type HeartbeatRequest struct {
+	Addr string `json:"addr"`
+}
+
+type HeartbeatResponse struct {
+	// Lease is how many seconds the tracker keeps the peer without
+	// hearing from it, 0 if it never expires peers.
+	Lease int64 `json:"lease"`
+}
+
+type GetManifestRequest struct {
+	Id string `json:"id"`
+}
+
+type PeersResponse struct {
+	Peers    []string             `json:"peers"`
+	LastSeen map[string]time.Time `json:"last_seen,omitempty"`
 }
 
+// Client uses the v1 API of the tracker, the errors sent by the tracker
+// are returned as *Error.
 type Client struct {
 	url string
 }
 
 func NewClient(url string) Client {
-	return Client{url}
+	return Client{strings.TrimSuffix(url, "/")}
 }
 
-func (c Client) GetAll() (GetAllResponse, error) {
-	rsp, err := http.Get(c.url + "?id=all")
+func (c Client) path(elems ...string) string {
+	p := c.url + "/v1"
+	for _, e := range elems {
+		p += "/" + url.PathEscape(e)
+	}
+	return p
+}
+
+// do sends a request with req encoded as JSON, if not nil, and decodes the
+// response in rsp, if not nil.
+func (c Client) do(method, path string, req, rsp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(req); err != nil {
+			return err
+		}
+		body = &buf
+	}
+	r, err := http.NewRequest(method, path, body)
 	if err != nil {
-		log.Println(err)
-		return GetAllResponse{}, err
+		return err
+	}
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := checkResponse(res); err != nil {
+		return err
 	}
-	defer rsp.Body.Close()
-	var files []GetAllItem
-	if err := json.NewDecoder(rsp.Body).Decode(&files); err != nil {
+	if rsp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(rsp)
+}
+
+func (c Client) GetAll() (GetAllResponse, error) {
+	return c.List(Query{})
+}
+
+// List returns the files selected by q.
+func (c Client) List(q Query) (GetAllResponse, error) {
+	p := c.path("files")
+	if v := q.Values(); len(v) != 0 {
+		p += "?" + v.Encode()
+	}
+	var r GetAllResponse
+	if err := c.do("GET", p, nil, &r); err != nil {
 		log.Println(err)
 		return GetAllResponse{}, err
 	}
-	return GetAllResponse{files}, nil
+	return r, nil
 }
 
 func (c Client) Get(req GetRequest) (GetResponse, error) {
-	rsp, err := http.Get(c.url + "?id=" + req.Id)
-	if err != nil {
-		log.Println(err)
-		return GetResponse{}, err
-	}
-	defer rsp.Body.Close()
 	var r GetResponse
-	if err := json.NewDecoder(rsp.Body).Decode(&r); err != nil {
+	if err := c.do("GET", c.path("files", req.Id), nil, &r); err != nil {
 		log.Println(err)
 		return GetResponse{}, err
 	}
 	return r, nil
 }
 
-func (c Client) Add(req AddRequest) error {
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(&req); err != nil {
-		return err
+func (c Client) GetPeers(req GetRequest) (PeersResponse, error) {
+	var r PeersResponse
+	if err := c.do("GET", c.path("files", req.Id, "peers"), nil, &r); err != nil {
+		log.Println(err)
+		return PeersResponse{}, err
 	}
-	rsp, err := http.Post(c.url, "application/json", &buf)
-	if err != nil {
-		return err
+	return r, nil
+}
+
+func (c Client) GetManifest(req GetManifestRequest) (Manifest, error) {
+	var m Manifest
+	if err := c.do("GET", c.path("files", req.Id, "manifest"), nil, &m); err != nil {
+		log.Println(err)
+		return Manifest{}, err
 	}
-	defer rsp.Body.Close()
-	return nil
+	return m, nil
+}
+
+func (c Client) Add(req AddRequest) error {
+	return c.do("POST", c.path("files"), &req, nil)
 }
 
 func (c Client) Remove(req RemoveRequest) error {
-	query := "?id=" + req.Id + "&addr=" + req.Addr
-	r, err := http.NewRequest("DELETE", c.url+query, nil)
-	if err != nil {
-		return err
+	return c.do("DELETE", c.path("files", req.Id, "peers", req.Addr), nil, nil)
+}
+
+func (c Client) Heartbeat(req HeartbeatRequest) (HeartbeatResponse, error) {
+	var r HeartbeatResponse
+	err := c.do("POST", c.path("heartbeat"), &req, &r)
+	if errors.Is(err, ErrNotFound) {
+		return HeartbeatResponse{}, ErrUnknownPeer
 	}
-	client := http.DefaultClient
-	rsp, err := client.Do(r)
 	if err != nil {
-		return err
+		return HeartbeatResponse{}, err
 	}
-	defer rsp.Body.Close()
-	return nil
+	return r, nil
 }
@@ -1,6 +1,6 @@
 module github.com/aburdulescu/ez
 
-go 1.17
+go 1.18
 
 require (
 	github.com/VividCortex/ewma v1.2.0 // indirect
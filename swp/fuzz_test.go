@@ -0,0 +1,131 @@
+package swp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// fuzzSeeds are valid messages of every type, the fuzzers start from them.
+var fuzzSeeds = []Msg{
+	Connect{Id: "id0"},
+	Disconnect{},
+	Getchunk{Index: 42},
+	Getchunk{Index: 42, Handle: 3},
+	Ack{},
+	Chunkinfo{NPieces: 3, Checksum: 1234},
+	Piece{Piece: []byte{0, 1, 2, 3}},
+	Getchecksums{Start: 1000},
+	Checksums{Total: 2, Checksums: []uint64{1, 2}},
+	Hello{Version: Version, Caps: SupportedCaps, MaxFrame: DefaultMaxFrame, Impl: "ezs"},
+	Error{Code: ERR_BUSY, Text: "too many clients"},
+	Getrange{Offset: 1 << 40, Length: 4096, Handle: 1},
+	Open{Id: "id1"},
+	Opened{Handle: 1},
+	Close{Handle: 1},
+	Ping{Seq: 1},
+	Pong{Seq: 1},
+	Cancel{},
+}
+
+func marshalSeed(t testing.TB, msg Msg) []byte {
+	b := make([]byte, msg.Size())
+	if err := Marshal(msg, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, msg := range fuzzSeeds {
+		f.Add(marshalSeed(f, msg))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{byte(GETCHUNK), 1})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := Unmarshal(b)
+		if err != nil {
+			if !IsDecodeError(err) {
+				t.Fatalf("%v is not a DecodeError", err)
+			}
+			return
+		}
+		if msg == nil {
+			t.Fatal("no message and no error")
+		}
+		if msg.Type() != MsgType(b[0]) {
+			t.Fatalf("type %v decoded as %v", MsgType(b[0]), msg.Type())
+		}
+	})
+}
+
+// FuzzRoundTrip checks that the decoded messages are encoded back to the
+// same message.
+func FuzzRoundTrip(f *testing.F) {
+	for _, msg := range fuzzSeeds {
+		f.Add(marshalSeed(f, msg))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := Unmarshal(b)
+		if err != nil {
+			return
+		}
+		if msg.Size() > len(b) {
+			t.Fatalf("%v needs %d bytes, decoded from %d", msg.Type(), msg.Size(), len(b))
+		}
+		out := make([]byte, msg.Size())
+		if err := Marshal(msg, out); err != nil {
+			t.Fatal(err)
+		}
+		again, err := Unmarshal(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatalf("%#v encoded as %#v", msg, again)
+		}
+	})
+}
+
+// FuzzRecv reads a stream of frames, with every framing, until it fails. It
+// must fail with an error, not a panic, and the messages read before must be
+// valid.
+func FuzzRecv(f *testing.F) {
+	for _, framing := range []Framing{LegacyFraming, WideFraming(DefaultMaxFrame)} {
+		for _, tagged := range []bool{false, true} {
+			framing.Tagged = tagged
+			var stream bytes.Buffer
+			for i, msg := range fuzzSeeds {
+				if err := framing.SendTagged(&stream, uint32(i), msg); err != nil {
+					f.Fatal(err)
+				}
+			}
+			f.Add(stream.Bytes(), framing.LenSize == 4, tagged)
+		}
+	}
+	f.Add([]byte{0, 0}, false, false)
+	f.Add([]byte{0xff, 0xff, byte(PIECE)}, false, false)
+	f.Fuzz(func(t *testing.T, b []byte, wide, tagged bool) {
+		framing := LegacyFraming
+		if wide {
+			framing = WideFraming(DefaultMaxFrame)
+		}
+		framing.Tagged = tagged
+		r := bytes.NewReader(b)
+		for {
+			_, msg, cleanup, err := framing.RecvTagged(r)
+			if err != nil {
+				if errors.Is(err, io.EOF) && r.Len() != 0 {
+					t.Fatalf("EOF with %d bytes left", r.Len())
+				}
+				return
+			}
+			if msg == nil {
+				t.Fatal("no message and no error")
+			}
+			cleanup()
+		}
+	})
+}
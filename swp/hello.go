@@ -0,0 +1,88 @@
+package swp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Version is the version of the protocol implemented by this package.
+// Peers which don't send HELLO are treated as version 0 and get no
+// capabilities.
+const Version = 1
+
+// MinVersion is the oldest version this package still interoperates with,
+// among the peers which send HELLO.
+const MinVersion = 1
+
+// Caps is a set of optional protocol features supported by a peer.
+type Caps uint64
+
+const (
+	// CapChecksums: the peer answers GETCHECKSUMS
+	CapChecksums Caps = 1 << iota
+	// CapWideFrames: the peer can switch to frames with a 4 bytes length,
+	// up to the MaxFrame it sent in HELLO
+	CapWideFrames
+	// CapRequestIds: every frame carries the id of the request it belongs
+	// to, so many requests can be in flight and answered in any order
+	CapRequestIds
+	// CapRange: the peer answers GETRANGE
+	CapRange
+	// CapHandles: the peer answers OPEN and CLOSE and takes handles in the
+	// file requests
+	CapHandles
+	// CapKeepalive: the peer answers PING
+	CapKeepalive
+	// CapCancel: the peer stops answering a request when it gets CANCEL for
+	// it, needs CapRequestIds
+	CapCancel
+)
+
+// SupportedCaps are the capabilities implemented by this package.
+const SupportedCaps = CapChecksums | CapWideFrames | CapRequestIds | CapRange | CapHandles | CapKeepalive | CapCancel
+
+func (c Caps) Has(caps Caps) bool {
+	return c&caps == caps
+}
+
+var ErrVersionMismatch = errors.New("protocol version mismatch")
+
+// NewHello returns the HELLO message sent by impl, which accepts frames up
+// to maxFrame bytes.
+func NewHello(impl string, maxFrame int) Hello {
+	return Hello{Version: Version, Caps: SupportedCaps, MaxFrame: uint32(maxFrame), Impl: impl}
+}
+
+// Negotiate returns what both sides of a connection can use: the lower of the
+// two versions, the capabilities supported by both and the smaller max frame
+// size. It fails if the resulting version is older than MinVersion.
+func Negotiate(local, remote Hello) (Hello, error) {
+	h := Hello{
+		Version:  local.Version,
+		Caps:     local.Caps & remote.Caps,
+		MaxFrame: local.MaxFrame,
+		Impl:     remote.Impl,
+	}
+	if remote.Version < h.Version {
+		h.Version = remote.Version
+	}
+	if remote.MaxFrame < h.MaxFrame {
+		h.MaxFrame = remote.MaxFrame
+	}
+	if !h.Caps.Has(CapWideFrames) || h.MaxFrame < LegacyMaxFrame {
+		h.Caps &^= CapWideFrames
+		h.MaxFrame = LegacyMaxFrame
+	}
+	if !h.Caps.Has(CapRequestIds) {
+		h.Caps &^= CapCancel
+	}
+	if h.Version < MinVersion {
+		return Hello{}, fmt.Errorf("%w: %s speaks version %d, need at least %d", ErrVersionMismatch, remote.Impl, remote.Version, MinVersion)
+	}
+	return h, nil
+}
+
+// Legacy returns what is assumed about a peer which didn't answer HELLO.
+func Legacy() Hello {
+	return Hello{Version: 0, Caps: 0, MaxFrame: LegacyMaxFrame, Impl: "legacy"}
+}
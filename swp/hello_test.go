@@ -0,0 +1,51 @@
+package swp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	t.Run("Older", func(t *testing.T) {
+		local := Hello{Version: Version + 1, Caps: CapChecksums | CapWideFrames | 1<<10, MaxFrame: DefaultMaxFrame, Impl: "new"}
+		remote := Hello{Version: Version, Caps: CapChecksums, MaxFrame: LegacyMaxFrame, Impl: "old"}
+		h, err := Negotiate(local, remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Version != Version || h.Caps != CapChecksums || h.Impl != "old" {
+			t.Fatalf("unexpected result: %v", h)
+		}
+		if FramingFor(h) != LegacyFraming {
+			t.Fatalf("expected legacy framing, got %v", FramingFor(h))
+		}
+	})
+	t.Run("WideFrames", func(t *testing.T) {
+		h, err := Negotiate(NewHello("a", DefaultMaxFrame), NewHello("b", 1<<18))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := WideFraming(1 << 18)
+		expected.Tagged = true
+		if f := FramingFor(h); f != expected {
+			t.Fatalf("expected %v, got %v", expected, f)
+		}
+	})
+	t.Run("CancelNeedsRequestIds", func(t *testing.T) {
+		remote := Hello{Version: Version, Caps: CapCancel, MaxFrame: LegacyMaxFrame, Impl: "odd"}
+		h, err := Negotiate(NewHello("new", DefaultMaxFrame), remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Caps.Has(CapCancel) {
+			t.Fatalf("CANCEL negotiated without request ids: %v", h)
+		}
+	})
+	t.Run("TooOld", func(t *testing.T) {
+		remote := Hello{Version: MinVersion - 1, Caps: 0, Impl: "old"}
+		_, err := Negotiate(NewHello("new", DefaultMaxFrame), remote)
+		if !errors.Is(err, ErrVersionMismatch) {
+			t.Fatalf("expected %v, got %v", ErrVersionMismatch, err)
+		}
+	})
+}
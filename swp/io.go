@@ -1,79 +1,299 @@
 package swp
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"sync"
+	"time"
 )
 
-func msgSize(r io.Reader) (int, error) {
-	b := make([]byte, 2)
-	_, err := io.ReadAtLeast(r, b, 2)
+// LegacyMaxFrame is the biggest frame which can be sent with a 2 bytes
+// length, the only framing known by peers without CapWideFrames.
+const LegacyMaxFrame = 1<<16 - 1
+
+// DefaultMaxFrame is the biggest frame accepted by default when wide frames
+// are used, it fits a 1 MiB piece.
+const DefaultMaxFrame = 1<<20 + 64
+
+var ErrFrameTooBig = errors.New("frame too big")
+
+// ErrBrokenFrame is returned when a frame could be sent only in part, the
+// connection can't be used anymore.
+var ErrBrokenFrame = errors.New("frame sent in part")
+
+// TagSize is the size of the request id carried by tagged frames.
+const TagSize = 4
+
+// Framing describes how messages are delimited on a connection: every
+// message is preceded by its length, stored in LenSize bytes, and can't be
+// longer than MaxFrame. If Tagged is set, the length is followed by the id of
+// the request the message belongs to.
+type Framing struct {
+	LenSize  int
+	MaxFrame int
+	Tagged   bool
+}
+
+var LegacyFraming = Framing{LenSize: 2, MaxFrame: LegacyMaxFrame}
+
+// WideFraming returns the framing with a 4 bytes length.
+func WideFraming(maxFrame int) Framing {
+	return Framing{LenSize: 4, MaxFrame: maxFrame}
+}
+
+// FramingFor returns the framing agreed by the HELLO exchange.
+func FramingFor(h Hello) Framing {
+	f := LegacyFraming
+	if h.Caps.Has(CapWideFrames) {
+		f = WideFraming(int(h.MaxFrame))
+	}
+	f.Tagged = h.Caps.Has(CapRequestIds)
+	return f
+}
+
+// Overhead returns how many bytes of a frame are not used by the message.
+func (f Framing) Overhead() int {
+	if f.Tagged {
+		return TagSize
+	}
+	return 0
+}
+
+func (f Framing) msgSize(r io.Reader) (int, error) {
+	b := make([]byte, f.LenSize)
+	_, err := io.ReadAtLeast(r, b, f.LenSize)
 	if err != nil {
 		log.Println(err)
 		return -1, err
 	}
-	size := binary.LittleEndian.Uint16(b)
-	return int(size), nil
+	var size int
+	if f.LenSize == 2 {
+		size = int(binary.LittleEndian.Uint16(b))
+	} else {
+		size = int(binary.LittleEndian.Uint32(b))
+	}
+	if size > f.MaxFrame {
+		return -1, fmt.Errorf("%w: %d > %d", ErrFrameTooBig, size, f.MaxFrame)
+	}
+	return size, nil
 }
 
-func read(r io.Reader) ([]byte, error) {
-	msgsize, err := msgSize(r)
+func (f Framing) read(r io.Reader) ([]byte, error) {
+	msgsize, err := f.msgSize(r)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 	src := io.LimitReader(r, int64(msgsize))
 	buf := AllocMsgbuf(msgsize)
-	n, err := buf.ReadFrom(src)
+	n, err := buf.Fill(src)
 	if err != nil {
 		log.Println(n, err)
+		ReleaseMsgbuf(buf.Bytes())
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-func write(w io.Writer, b []byte) error {
-	const msgMaxSize = (1 << 16) - 1
-	if len(b) > msgMaxSize {
-		return fmt.Errorf("msg len too big")
+// write sends b, which starts with f.LenSize bytes reserved for the length.
+func (f Framing) write(w io.Writer, b []byte) error {
+	size := len(b) - f.LenSize
+	if size > f.MaxFrame {
+		return fmt.Errorf("%w: %d > %d", ErrFrameTooBig, size, f.MaxFrame)
 	}
-	binary.LittleEndian.PutUint16(b[:2], uint16(len(b[2:])))
-	buf := bytes.NewBuffer(b)
-	copyBuf := make([]byte, buf.Len()) // TODO: PERF: this should be avoided!
-	n, err := io.CopyBuffer(w, buf, copyBuf)
+	if f.LenSize == 2 {
+		binary.LittleEndian.PutUint16(b[:2], uint16(size))
+	} else {
+		binary.LittleEndian.PutUint32(b[:4], uint32(size))
+	}
+	n, err := w.Write(b)
 	if err != nil {
-		log.Println(buf.Len(), n, err)
+		log.Println(len(b), n, err)
 		return err
 	}
 	return nil
 }
 
-func Send(w io.Writer, msg Msg) error {
-	b := AllocMsgbuf(2 + msg.Size()).Bytes()
+func (f Framing) Send(w io.Writer, msg Msg) error {
+	return f.SendTagged(w, 0, msg)
+}
+
+// SendTagged writes msg as part of the request with the given id, the id is
+// left out if the framing is not tagged. Pieces are not copied, the frame
+// header and the piece are written with one vectored write if w supports it.
+func (f Framing) SendTagged(w io.Writer, tag uint32, msg Msg) error {
+	if p, ok := msg.(Piece); ok {
+		hdr, err := f.pieceHeader(tag, len(p.Piece))
+		if err != nil {
+			return err
+		}
+		bufs := net.Buffers{hdr, p.Piece}
+		if _, err := bufs.WriteTo(w); err != nil {
+			log.Println(err)
+			return err
+		}
+		return nil
+	}
+	hdrSize := f.LenSize + f.Overhead()
+	b := AllocMsgbuf(hdrSize + msg.Size()).Bytes()
 	defer ReleaseMsgbuf(b)
-	if err := Marshal(msg, b[2:]); err != nil {
+	if f.Tagged {
+		binary.LittleEndian.PutUint32(b[f.LenSize:], tag)
+	}
+	if err := Marshal(msg, b[hdrSize:]); err != nil {
 		return err
 	}
-	if err := write(w, b); err != nil {
+	if err := f.write(w, b); err != nil {
 		return err
 	}
 	return nil
 }
 
-func Recv(r io.Reader) (Msg, func(), error) {
-	b, err := read(r)
+// pieceHeader returns what precedes a piece of n bytes in its frame: the
+// length, the tag and the message type.
+func (f Framing) pieceHeader(tag uint32, n int) ([]byte, error) {
+	size := f.Overhead() + Piece{}.Size() + n
+	if size > f.MaxFrame {
+		return nil, fmt.Errorf("%w: %d > %d", ErrFrameTooBig, size, f.MaxFrame)
+	}
+	b := make([]byte, f.LenSize+f.Overhead()+Piece{}.Size())
+	if f.LenSize == 2 {
+		binary.LittleEndian.PutUint16(b[:2], uint16(size))
+	} else {
+		binary.LittleEndian.PutUint32(b[:4], uint32(size))
+	}
+	if f.Tagged {
+		binary.LittleEndian.PutUint32(b[f.LenSize:], tag)
+	}
+	b[len(b)-1] = byte(PIECE)
+	return b, nil
+}
+
+func (f Framing) Recv(r io.Reader) (Msg, func(), error) {
+	_, msg, cleanup, err := f.RecvTagged(r)
+	return msg, cleanup, err
+}
+
+// RecvTagged reads a message and the id of the request it belongs to, which
+// is 0 if the framing is not tagged.
+func (f Framing) RecvTagged(r io.Reader) (uint32, Msg, func(), error) {
+	b, err := f.read(r)
 	if err != nil {
 		log.Println(err)
-		return nil, nil, err
+		return 0, nil, nil, err
 	}
-	msg, err := Unmarshal(b)
+	var tag uint32
+	payload := b
+	if f.Tagged {
+		if len(b) < TagSize {
+			ReleaseMsgbuf(b)
+			return 0, nil, nil, fmt.Errorf("%w: frame shorter than its tag", ErrPayloadTooSmall)
+		}
+		tag = binary.LittleEndian.Uint32(b)
+		payload = b[TagSize:]
+	}
+	msg, err := Unmarshal(payload)
 	if err != nil {
 		log.Println(err)
-		return nil, nil, err
+		ReleaseMsgbuf(b)
+		return tag, nil, nil, err
 	}
 	cleanup := func() { ReleaseMsgbuf(b) }
-	return msg, cleanup, nil
+	return tag, msg, cleanup, nil
+}
+
+// Send writes msg using the legacy framing.
+func Send(w io.Writer, msg Msg) error {
+	return LegacyFraming.Send(w, msg)
+}
+
+// Recv reads a message using the legacy framing.
+func Recv(r io.Reader) (Msg, func(), error) {
+	return LegacyFraming.Recv(r)
+}
+
+// Conn sends and receives messages on a connection whose framing can change
+// after the HELLO exchange. Send can be called from many goroutines, Recv
+// only from one.
+type Conn struct {
+	rw      io.ReadWriter
+	framing Framing
+	wmu     sync.Mutex
+
+	writeTimeout time.Duration
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// NewConn returns a Conn which uses the legacy framing.
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{rw: rw, framing: LegacyFraming}
+}
+
+func (c *Conn) Framing() Framing {
+	return c.framing
+}
+
+func (c *Conn) SetFraming(f Framing) {
+	c.framing = f
+}
+
+// SetWriteTimeout limits the time a Send can take, if the connection
+// supports deadlines. A Send which times out leaves the connection in an
+// unknown state, it must be closed.
+func (c *Conn) SetWriteTimeout(d time.Duration) {
+	c.wmu.Lock()
+	c.writeTimeout = d
+	c.wmu.Unlock()
+}
+
+func (c *Conn) Send(msg Msg) error {
+	return c.SendTagged(0, msg)
+}
+
+func (c *Conn) SendTagged(tag uint32, msg Msg) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if w, ok := c.rw.(writeDeadliner); ok && c.writeTimeout > 0 {
+		w.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.framing.SendTagged(c.rw, tag, msg)
+}
+
+// SendPieceFrom sends a PIECE with the next n bytes of r, without reading
+// them in memory first when possible: an *os.File positioned at the piece is
+// sent with sendfile if the connection is a TCP connection.
+func (c *Conn) SendPieceFrom(tag uint32, r io.Reader, n int) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if w, ok := c.rw.(writeDeadliner); ok && c.writeTimeout > 0 {
+		w.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	hdr, err := c.framing.pieceHeader(tag, n)
+	if err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(hdr); err != nil {
+		log.Println(err)
+		return fmt.Errorf("%w: %v", ErrBrokenFrame, err)
+	}
+	if _, err := io.CopyN(c.rw, r, int64(n)); err != nil {
+		log.Println(err)
+		return fmt.Errorf("%w: %v", ErrBrokenFrame, err)
+	}
+	return nil
+}
+
+func (c *Conn) Recv() (Msg, func(), error) {
+	return c.framing.Recv(c.rw)
+}
+
+func (c *Conn) RecvTagged() (uint32, Msg, func(), error) {
+	return c.framing.RecvTagged(c.rw)
 }
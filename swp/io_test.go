@@ -0,0 +1,103 @@
+package swp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/aburdulescu/ez/cmn"
+)
+
+func TestFraming(t *testing.T) {
+	t.Run("Wide", func(t *testing.T) {
+		var buf bytes.Buffer
+		f := WideFraming(DefaultMaxFrame)
+		piece := bytes.Repeat([]byte{7}, 1<<20)
+		if err := f.Send(&buf, Piece{Piece: piece}); err != nil {
+			t.Fatal(err)
+		}
+		msg, cleanup, err := f.Recv(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+		if err := compareByteSlice(msg.(Piece).Piece, piece); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("Tagged", func(t *testing.T) {
+		var buf bytes.Buffer
+		f := LegacyFraming
+		f.Tagged = true
+		if err := f.SendTagged(&buf, 42, Getchunk{Index: 3}); err != nil {
+			t.Fatal(err)
+		}
+		tag, msg, cleanup, err := f.RecvTagged(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+		if tag != 42 || msg.(Getchunk).Index != 3 {
+			t.Fatalf("unexpected message %d %v", tag, msg)
+		}
+	})
+	t.Run("TooBig", func(t *testing.T) {
+		var buf bytes.Buffer
+		piece := make([]byte, 1<<16)
+		if err := LegacyFraming.Send(&buf, Piece{Piece: piece}); !errors.Is(err, ErrFrameTooBig) {
+			t.Fatalf("expected %v, got %v", ErrFrameTooBig, err)
+		}
+		if err := WideFraming(DefaultMaxFrame).Send(&buf, Piece{Piece: piece}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := WideFraming(1 << 10).Recv(&buf); !errors.Is(err, ErrFrameTooBig) {
+			t.Fatalf("expected %v, got %v", ErrFrameTooBig, err)
+		}
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := LegacyFraming.Send(&buf, Piece{Piece: make([]byte, cmn.PieceSize)}); err != nil {
+			t.Fatal(err)
+		}
+		buf.Truncate(buf.Len() - 1)
+		if _, _, err := LegacyFraming.Recv(&buf); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+		}
+	})
+	t.Run("Empty", func(t *testing.T) {
+		buf := bytes.NewBuffer([]byte{0, 0})
+		if _, _, err := LegacyFraming.Recv(buf); !errors.Is(err, ErrEmptyInput) {
+			t.Fatalf("expected %v, got %v", ErrEmptyInput, err)
+		}
+	})
+}
+
+// BenchmarkChunk sends and receives a whole chunk, split in pieces of
+// different sizes.
+func BenchmarkChunk(b *testing.B) {
+	chunk := make([]byte, cmn.ChunkSize)
+	for _, pieceSize := range []int{cmn.PieceSize, 64 << 10, 256 << 10, 1 << 20} {
+		f := LegacyFraming
+		if pieceSize+(Piece{}).Size() > LegacyMaxFrame {
+			f = WideFraming(DefaultMaxFrame)
+		}
+		b.Run(fmt.Sprintf("%dKiB", pieceSize>>10), func(b *testing.B) {
+			var buf bytes.Buffer
+			b.SetBytes(cmn.ChunkSize)
+			for i := 0; i < b.N; i++ {
+				for off := 0; off < len(chunk); off += pieceSize {
+					if err := f.Send(&buf, Piece{Piece: chunk[off : off+pieceSize]}); err != nil {
+						b.Fatal(err)
+					}
+					_, cleanup, err := f.Recv(&buf)
+					if err != nil {
+						b.Fatal(err)
+					}
+					cleanup()
+				}
+			}
+		})
+	}
+}
@@ -25,13 +25,14 @@ func Marshal(msg Msg, b []byte) error {
 	case DISCONNECT:
 		return nil
 	case GETCHUNK:
-		if len(b[1:]) < 8 {
+		realMsg := msg.(Getchunk)
+		if len(b[1:]) < 8+realMsg.Handle.size() {
 			return ErrBufferTooSmall
 		}
-		realMsg := msg.(Getchunk)
 		binary.LittleEndian.PutUint64(b[1:], realMsg.Index)
+		putHandle(b[9:], realMsg.Handle)
 		return nil
-	case ACK:
+	case ACK, CANCEL:
 		return nil
 	case CHUNKINFO:
 		if len(b[1:]) < 8 {
@@ -51,7 +52,93 @@ func Marshal(msg Msg, b []byte) error {
 		}
 		copy(b[1:], realMsg.Piece)
 		return nil
+	case GETCHECKSUMS:
+		realMsg := msg.(Getchecksums)
+		if len(b[1:]) < 8+realMsg.Handle.size() {
+			return ErrBufferTooSmall
+		}
+		binary.LittleEndian.PutUint64(b[1:], realMsg.Start)
+		putHandle(b[9:], realMsg.Handle)
+		return nil
+	case CHECKSUMS:
+		realMsg := msg.(Checksums)
+		if len(b[1:]) < 8+8*len(realMsg.Checksums) {
+			return ErrBufferTooSmall
+		}
+		binary.LittleEndian.PutUint64(b[1:9], realMsg.Total)
+		for i, checksum := range realMsg.Checksums {
+			binary.LittleEndian.PutUint64(b[9+8*i:], checksum)
+		}
+		return nil
+	case HELLO:
+		realMsg := msg.(Hello)
+		impl := []byte(realMsg.Impl)
+		if len(b[1:]) < 2+8+4+len(impl) {
+			return ErrBufferTooSmall
+		}
+		binary.LittleEndian.PutUint16(b[1:3], realMsg.Version)
+		binary.LittleEndian.PutUint64(b[3:11], uint64(realMsg.Caps))
+		binary.LittleEndian.PutUint32(b[11:15], realMsg.MaxFrame)
+		copy(b[15:], impl)
+		return nil
+	case ERROR:
+		realMsg := msg.(Error)
+		text := []byte(realMsg.Text)
+		if len(b[1:]) < 2+len(text) {
+			return ErrBufferTooSmall
+		}
+		binary.LittleEndian.PutUint16(b[1:3], uint16(realMsg.Code))
+		copy(b[3:], text)
+		return nil
+	case GETRANGE:
+		realMsg := msg.(Getrange)
+		if len(b[1:]) < 8+8+realMsg.Handle.size() {
+			return ErrBufferTooSmall
+		}
+		binary.LittleEndian.PutUint64(b[1:9], realMsg.Offset)
+		binary.LittleEndian.PutUint64(b[9:17], realMsg.Length)
+		putHandle(b[17:], realMsg.Handle)
+		return nil
+	case OPEN:
+		realMsg := msg.(Open)
+		id := []byte(realMsg.Id)
+		if len(b[1:]) < len(id) {
+			return ErrBufferTooSmall
+		}
+		copy(b[1:], id)
+		return nil
+	case OPENED:
+		if len(b[1:]) < 4 {
+			return ErrBufferTooSmall
+		}
+		binary.LittleEndian.PutUint32(b[1:], uint32(msg.(Opened).Handle))
+		return nil
+	case CLOSE:
+		if len(b[1:]) < 4 {
+			return ErrBufferTooSmall
+		}
+		binary.LittleEndian.PutUint32(b[1:], uint32(msg.(Close).Handle))
+		return nil
+	case PING:
+		if len(b[1:]) < 8 {
+			return ErrBufferTooSmall
+		}
+		binary.LittleEndian.PutUint64(b[1:], msg.(Ping).Seq)
+		return nil
+	case PONG:
+		if len(b[1:]) < 8 {
+			return ErrBufferTooSmall
+		}
+		binary.LittleEndian.PutUint64(b[1:], msg.(Pong).Seq)
+		return nil
 	default:
 		return ErrUnknownMsg
 	}
 }
+
+// putHandle appends h to a request, unless it's the CONNECT file.
+func putHandle(b []byte, h Handle) {
+	if h != 0 {
+		binary.LittleEndian.PutUint32(b, uint32(h))
+	}
+}
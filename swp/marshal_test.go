@@ -69,14 +69,14 @@ func TestMarshal(t *testing.T) {
 	t.Run("Getchunk", func(t *testing.T) {
 		t.Run("BufferTooSmall", func(t *testing.T) {
 			b := make([]byte, 1)
-			if err := Marshal(Getchunk{42}, b); err != ErrBufferTooSmall {
+			if err := Marshal(Getchunk{Index: 42}, b); err != ErrBufferTooSmall {
 				t.Fatalf("expected %v, got %v", ErrBufferTooSmall, err)
 			}
 		})
 		t.Run("Good", func(t *testing.T) {
 			var expectedIndex uint64 = 42
 			b := make([]byte, 1+8)
-			if err := Marshal(Getchunk{expectedIndex}, b); err != nil {
+			if err := Marshal(Getchunk{Index: expectedIndex}, b); err != nil {
 				t.Fatal(err)
 			}
 			msgType := MsgType(b[0])
@@ -146,6 +146,59 @@ func TestMarshal(t *testing.T) {
 			}
 		})
 	})
+	t.Run("Getchecksums", func(t *testing.T) {
+		t.Run("BufferTooSmall", func(t *testing.T) {
+			b := make([]byte, 1)
+			if err := Marshal(Getchecksums{Start: 42}, b); err != ErrBufferTooSmall {
+				t.Fatalf("expected %v, got %v", ErrBufferTooSmall, err)
+			}
+		})
+		t.Run("Good", func(t *testing.T) {
+			var expectedStart uint64 = 42
+			b := make([]byte, 1+8)
+			if err := Marshal(Getchecksums{Start: expectedStart}, b); err != nil {
+				t.Fatal(err)
+			}
+			msgType := MsgType(b[0])
+			if msgType != GETCHECKSUMS {
+				t.Fatal("msg type not GETCHECKSUMS")
+			}
+			start := binary.LittleEndian.Uint64(b[1:])
+			if start != expectedStart {
+				t.Fatalf("expected %v, got %v", expectedStart, start)
+			}
+		})
+	})
+	t.Run("Checksums", func(t *testing.T) {
+		t.Run("BufferTooSmall", func(t *testing.T) {
+			b := make([]byte, 1+8)
+			if err := Marshal(Checksums{Total: 2, Checksums: []uint64{1, 2}}, b); err != ErrBufferTooSmall {
+				t.Fatalf("expected %v, got %v", ErrBufferTooSmall, err)
+			}
+		})
+		t.Run("Good", func(t *testing.T) {
+			expectedChecksums := []uint64{1234, 5678}
+			msg := Checksums{Total: 10, Checksums: expectedChecksums}
+			b := make([]byte, msg.Size())
+			if err := Marshal(msg, b); err != nil {
+				t.Fatal(err)
+			}
+			msgType := MsgType(b[0])
+			if msgType != CHECKSUMS {
+				t.Fatal("msg type not CHECKSUMS")
+			}
+			total := binary.LittleEndian.Uint64(b[1:9])
+			if total != 10 {
+				t.Fatalf("expected %v, got %v", 10, total)
+			}
+			for i := range expectedChecksums {
+				checksum := binary.LittleEndian.Uint64(b[9+8*i:])
+				if checksum != expectedChecksums[i] {
+					t.Fatalf("expected %v, got %v", expectedChecksums[i], checksum)
+				}
+			}
+		})
+	})
 }
 
 func BenchmarkMarshalPiece(b *testing.B) {
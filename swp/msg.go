@@ -9,6 +9,17 @@ const (
 	ACK
 	CHUNKINFO
 	PIECE
+	GETCHECKSUMS
+	CHECKSUMS
+	HELLO
+	ERROR
+	GETRANGE
+	OPEN
+	OPENED
+	CLOSE
+	PING
+	PONG
+	CANCEL
 )
 
 func (t MsgType) String() string {
@@ -25,6 +36,28 @@ func (t MsgType) String() string {
 		return "CHUNKINFO"
 	case PIECE:
 		return "PIECE"
+	case GETCHECKSUMS:
+		return "GETCHECKSUMS"
+	case CHECKSUMS:
+		return "CHECKSUMS"
+	case HELLO:
+		return "HELLO"
+	case ERROR:
+		return "ERROR"
+	case GETRANGE:
+		return "GETRANGE"
+	case OPEN:
+		return "OPEN"
+	case OPENED:
+		return "OPENED"
+	case CLOSE:
+		return "CLOSE"
+	case PING:
+		return "PING"
+	case PONG:
+		return "PONG"
+	case CANCEL:
+		return "CANCEL"
 	default:
 		return "UNKNOWN"
 	}
@@ -60,8 +93,21 @@ func (r Disconnect) Size() int {
 	return headerSize
 }
 
+// Handle identifies a file opened on a connection with OPEN. Handle 0 is the
+// file opened with CONNECT; it is not sent on the wire, so the requests for it
+// look the same as before handles existed.
+type Handle uint32
+
+func (h Handle) size() int {
+	if h == 0 {
+		return 0
+	}
+	return 4
+}
+
 type Getchunk struct {
-	Index uint64
+	Index  uint64
+	Handle Handle
 }
 
 func (r Getchunk) Type() MsgType {
@@ -69,7 +115,7 @@ func (r Getchunk) Type() MsgType {
 }
 
 func (r Getchunk) Size() int {
-	return headerSize + 8
+	return headerSize + 8 + r.Handle.size()
 }
 
 type Ack struct {
@@ -107,3 +153,201 @@ func (r Piece) Type() MsgType {
 func (r Piece) Size() int {
 	return headerSize + len(r.Piece)
 }
+
+// Getchecksums asks for the checksums of the chunks of the connected file,
+// starting with the chunk at index Start.
+type Getchecksums struct {
+	Start  uint64
+	Handle Handle
+}
+
+func (r Getchecksums) Type() MsgType {
+	return GETCHECKSUMS
+}
+
+func (r Getchecksums) Size() int {
+	return headerSize + 8 + r.Handle.size()
+}
+
+// MaxChecksums is the max number of checksums sent in one CHECKSUMS message,
+// Total tells how many checksums there are in total.
+const MaxChecksums = 1000
+
+type Checksums struct {
+	Total     uint64
+	Checksums []uint64
+}
+
+func (r Checksums) Type() MsgType {
+	return CHECKSUMS
+}
+
+func (r Checksums) Size() int {
+	return headerSize + 8 + 8*len(r.Checksums)
+}
+
+// Hello is the first message sent on a connection by both sides, see
+// Negotiate.
+type Hello struct {
+	Version  uint16
+	Caps     Caps
+	MaxFrame uint32
+	Impl     string
+}
+
+func (r Hello) Type() MsgType {
+	return HELLO
+}
+
+func (r Hello) Size() int {
+	return headerSize + 2 + 8 + 4 + len([]byte(r.Impl))
+}
+
+// Getrange asks for Length bytes of the connected file, starting at Offset.
+// Length can't be bigger than cmn.ChunkSize; a range which goes past the end
+// of the file is cut short. The answer is the same as for GETCHUNK, with the
+// checksum of the range.
+type Getrange struct {
+	Offset uint64
+	Length uint64
+	Handle Handle
+}
+
+func (r Getrange) Type() MsgType {
+	return GETRANGE
+}
+
+func (r Getrange) Size() int {
+	return headerSize + 8 + 8 + r.Handle.size()
+}
+
+// Open opens another file on the connection, the answer is OPENED with the
+// handle used for it in the following requests.
+type Open struct {
+	Id string
+}
+
+func (r Open) Type() MsgType {
+	return OPEN
+}
+
+func (r Open) Size() int {
+	return headerSize + len([]byte(r.Id))
+}
+
+type Opened struct {
+	Handle Handle
+}
+
+func (r Opened) Type() MsgType {
+	return OPENED
+}
+
+func (r Opened) Size() int {
+	return headerSize + 4
+}
+
+// Close closes a file opened with OPEN, the answer is ACK.
+type Close struct {
+	Handle Handle
+}
+
+func (r Close) Type() MsgType {
+	return CLOSE
+}
+
+func (r Close) Size() int {
+	return headerSize + 4
+}
+
+// Ping checks that the peer is still there, the answer is a PONG with the
+// same Seq.
+type Ping struct {
+	Seq uint64
+}
+
+func (r Ping) Type() MsgType {
+	return PING
+}
+
+func (r Ping) Size() int {
+	return headerSize + 8
+}
+
+type Pong struct {
+	Seq uint64
+}
+
+func (r Pong) Type() MsgType {
+	return PONG
+}
+
+func (r Pong) Size() int {
+	return headerSize + 8
+}
+
+// Cancel aborts the request whose id is in the frame, so it can only be
+// sent with tagged framing. The seeder stops at the next piece and sends an
+// ACK with the id of the request, which is the last response to it; the ACK
+// is sent even if the request was already done.
+type Cancel struct {
+}
+
+func (r Cancel) Type() MsgType {
+	return CANCEL
+}
+
+func (r Cancel) Size() int {
+	return headerSize
+}
+
+type ErrCode uint16
+
+const (
+	ERR_UNKNOWN_ID ErrCode = iota + 1
+	ERR_IO
+	ERR_OUT_OF_RANGE
+	ERR_NOT_CONNECTED
+	ERR_BUSY
+	ERR_BAD_REQUEST
+)
+
+func (c ErrCode) String() string {
+	switch c {
+	case ERR_UNKNOWN_ID:
+		return "unknown id"
+	case ERR_IO:
+		return "io failure"
+	case ERR_OUT_OF_RANGE:
+		return "chunk out of range"
+	case ERR_NOT_CONNECTED:
+		return "not connected"
+	case ERR_BUSY:
+		return "busy"
+	case ERR_BAD_REQUEST:
+		return "bad request"
+	default:
+		return "unknown error"
+	}
+}
+
+// Error is sent instead of the expected response when a request fails.
+type Error struct {
+	Code ErrCode
+	Text string
+}
+
+func (r Error) Type() MsgType {
+	return ERROR
+}
+
+func (r Error) Size() int {
+	return headerSize + 2 + len([]byte(r.Text))
+}
+
+func (r Error) Error() string {
+	if r.Text == "" {
+		return r.Code.String()
+	}
+	return r.Code.String() + ": " + r.Text
+}
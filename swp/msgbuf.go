@@ -11,24 +11,51 @@ import (
 const EXTRA_MEMORY = 16
 const POOL_BUF_SIZE = cmn.PieceSize + EXTRA_MEMORY
 
-var msgbufPool = sync.Pool{
-	New: func() interface{} {
-		return make([]byte, POOL_BUF_SIZE)
-	},
+// POOL_COUNT is the number of buffer sizes which are pooled, the biggest
+// one fits a 1 MiB piece.
+const POOL_COUNT = 8
+
+// msgbufPools hold the buffers of the messages which carry pieces, there is
+// one pool for every power of two piece size, starting with cmn.PieceSize.
+var msgbufPools [POOL_COUNT]sync.Pool
+
+func init() {
+	for i := range msgbufPools {
+		size := cmn.PieceSize<<i + EXTRA_MEMORY
+		msgbufPools[i].New = func() interface{} {
+			return make([]byte, size)
+		}
+	}
+}
+
+// poolIndex returns the pool with the smallest buffers which can hold size
+// bytes, or -1 if the size is not pooled.
+func poolIndex(size int) int {
+	for i := range msgbufPools {
+		if size <= cmn.PieceSize<<i+EXTRA_MEMORY {
+			return i
+		}
+	}
+	return -1
 }
 
 func AllocMsgbuf(size int) MsgBuffer {
 	if size >= cmn.PieceSize {
-		b := msgbufPool.Get().([]byte)
-		return MsgBuffer{b[:size]}
-	} else {
-		return NewMsgBuffer(size)
+		if i := poolIndex(size); i != -1 {
+			b := msgbufPools[i].Get().([]byte)
+			return MsgBuffer{b[:size]}
+		}
 	}
+	return NewMsgBuffer(size)
 }
 
 func ReleaseMsgbuf(b []byte) {
-	if len(b) >= cmn.PieceSize {
-		msgbufPool.Put(b[:POOL_BUF_SIZE]) // TODO: PERF: this causes GC activity
+	if len(b) < cmn.PieceSize {
+		return
+	}
+	i := poolIndex(cap(b))
+	if i != -1 && cap(b) == cmn.PieceSize<<i+EXTRA_MEMORY {
+		msgbufPools[i].Put(b[:cap(b)]) // TODO: PERF: this causes GC activity
 	}
 }
 
@@ -44,22 +71,25 @@ func (b MsgBuffer) Bytes() []byte {
 	return b.buf
 }
 
-func (b MsgBuffer) ReadFrom(r io.Reader) (int, error) {
+// Fill reads from r until the buffer is full. If r ends before that,
+// io.ErrUnexpectedEOF is returned.
+func (b MsgBuffer) Fill(r io.Reader) (int, error) {
 	nread := 0
 	buf := b.buf
-	for {
+	for nread < len(b.buf) {
 		n, err := r.Read(buf)
 		nread += n
 		if err == io.EOF {
-			return nread, nil
+			if nread == len(b.buf) {
+				break
+			}
+			return nread, io.ErrUnexpectedEOF
 		}
 		if err != nil {
 			log.Println(err)
 			return nread, err
 		}
-		if nread == len(b.buf) {
-			return nread, nil
-		}
 		buf = b.buf[nread:]
 	}
+	return nread, nil
 }
@@ -3,27 +3,65 @@ package swp
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 )
 
 var ErrUnknownMsg = errors.New("unknown msg")
 var ErrEmptyInput = errors.New("empty input")
 var ErrEmptyPayload = errors.New("empty payload")
 var ErrPayloadTooSmall = errors.New("payload too small")
+var ErrPayloadTooBig = errors.New("payload too big")
+
+// DecodeError is returned by Unmarshal for bytes which are not a valid
+// message, Err is one of the errors above.
+type DecodeError struct {
+	Type MsgType
+	Err  error
+}
+
+func (e DecodeError) Error() string {
+	if e.Err == ErrEmptyInput {
+		return "decode: " + e.Err.Error()
+	}
+	return fmt.Sprintf("decode %s: %v", e.Type, e.Err)
+}
+
+func (e DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// IsDecodeError returns true if err comes from a message which was read
+// completely but couldn't be decoded.
+func IsDecodeError(err error) bool {
+	var decodeErr DecodeError
+	return errors.As(err, &decodeErr)
+}
 
 // b0 = MsgType
 // b1, ... = Payload
 // Call Type method on returned Msg and convert it to appropriate impl
 // Ex:
-//   if msg.Type == CONNECT {
-//      connect := msg.(Connect)
-//      fmt.Println(connect.Id)
-//   }
+//
+//	if msg.Type == CONNECT {
+//	   connect := msg.(Connect)
+//	   fmt.Println(connect.Id)
+//	}
+//
+// Every message is checked to have exactly the size of its fields, if not a
+// DecodeError is returned.
 func Unmarshal(b []byte) (Msg, error) {
-	if b == nil {
-		return nil, ErrEmptyInput
+	if len(b) == 0 {
+		return nil, DecodeError{Err: ErrEmptyInput}
 	}
 	msgType := MsgType(b[0])
-	payload := b[1:]
+	msg, err := decode(msgType, b[1:])
+	if err != nil {
+		return nil, DecodeError{Type: msgType, Err: err}
+	}
+	return msg, nil
+}
+
+func decode(msgType MsgType, payload []byte) (Msg, error) {
 	switch msgType {
 	case CONNECT:
 		if len(payload) == 0 {
@@ -32,23 +70,27 @@ func Unmarshal(b []byte) (Msg, error) {
 		id := string(payload)
 		return Connect{id}, nil
 	case DISCONNECT:
+		if err := checkSize(payload, 0); err != nil {
+			return nil, err
+		}
 		return Disconnect{}, nil
 	case GETCHUNK:
-		if len(payload) == 0 {
-			return nil, ErrEmptyPayload
+		if err := checkRequestSize(payload, 8); err != nil {
+			return nil, err
 		}
 		index := binary.LittleEndian.Uint64(payload)
-		return Getchunk{index}, nil
+		handle := getHandle(payload[8:])
+		return Getchunk{Index: index, Handle: handle}, nil
 	case ACK:
+		if err := checkSize(payload, 0); err != nil {
+			return nil, err
+		}
 		return Ack{}, nil
 	case CHUNKINFO:
-		if len(payload) < 8 {
-			return nil, ErrPayloadTooSmall
+		if err := checkSize(payload, 8+8); err != nil {
+			return nil, err
 		}
 		npieces := binary.LittleEndian.Uint64(payload[:8])
-		if len(payload[8:]) < 8 {
-			return nil, ErrPayloadTooSmall
-		}
 		checksum := binary.LittleEndian.Uint64(payload[8:])
 		return Chunkinfo{NPieces: npieces, Checksum: checksum}, nil
 	case PIECE:
@@ -57,7 +99,117 @@ func Unmarshal(b []byte) (Msg, error) {
 		}
 		piece := payload
 		return Piece{Piece: piece}, nil
+	case GETCHECKSUMS:
+		if err := checkRequestSize(payload, 8); err != nil {
+			return nil, err
+		}
+		start := binary.LittleEndian.Uint64(payload)
+		handle := getHandle(payload[8:])
+		return Getchecksums{Start: start, Handle: handle}, nil
+	case CHECKSUMS:
+		if len(payload) < 8 {
+			return nil, ErrPayloadTooSmall
+		}
+		total := binary.LittleEndian.Uint64(payload[:8])
+		payload = payload[8:]
+		if len(payload)%8 != 0 {
+			return nil, ErrPayloadTooSmall
+		}
+		if len(payload)/8 > MaxChecksums {
+			return nil, ErrPayloadTooBig
+		}
+		checksums := make([]uint64, len(payload)/8)
+		for i := range checksums {
+			checksums[i] = binary.LittleEndian.Uint64(payload[8*i:])
+		}
+		return Checksums{Total: total, Checksums: checksums}, nil
+	case HELLO:
+		if len(payload) < 2+8+4 {
+			return nil, ErrPayloadTooSmall
+		}
+		version := binary.LittleEndian.Uint16(payload[:2])
+		caps := Caps(binary.LittleEndian.Uint64(payload[2:10]))
+		maxFrame := binary.LittleEndian.Uint32(payload[10:14])
+		impl := string(payload[14:])
+		return Hello{Version: version, Caps: caps, MaxFrame: maxFrame, Impl: impl}, nil
+	case ERROR:
+		if len(payload) < 2 {
+			return nil, ErrPayloadTooSmall
+		}
+		code := ErrCode(binary.LittleEndian.Uint16(payload[:2]))
+		text := string(payload[2:])
+		return Error{Code: code, Text: text}, nil
+	case GETRANGE:
+		if err := checkRequestSize(payload, 8+8); err != nil {
+			return nil, err
+		}
+		offset := binary.LittleEndian.Uint64(payload[:8])
+		length := binary.LittleEndian.Uint64(payload[8:16])
+		handle := getHandle(payload[16:])
+		return Getrange{Offset: offset, Length: length, Handle: handle}, nil
+	case OPEN:
+		if len(payload) == 0 {
+			return nil, ErrEmptyPayload
+		}
+		return Open{Id: string(payload)}, nil
+	case OPENED:
+		if err := checkSize(payload, 4); err != nil {
+			return nil, err
+		}
+		return Opened{Handle: Handle(binary.LittleEndian.Uint32(payload))}, nil
+	case CLOSE:
+		if err := checkSize(payload, 4); err != nil {
+			return nil, err
+		}
+		return Close{Handle: Handle(binary.LittleEndian.Uint32(payload))}, nil
+	case PING:
+		if err := checkSize(payload, 8); err != nil {
+			return nil, err
+		}
+		return Ping{Seq: binary.LittleEndian.Uint64(payload)}, nil
+	case PONG:
+		if err := checkSize(payload, 8); err != nil {
+			return nil, err
+		}
+		return Pong{Seq: binary.LittleEndian.Uint64(payload)}, nil
+	case CANCEL:
+		if err := checkSize(payload, 0); err != nil {
+			return nil, err
+		}
+		return Cancel{}, nil
 	default:
 		return nil, ErrUnknownMsg
 	}
 }
+
+// checkSize checks that payload has exactly size bytes.
+func checkSize(payload []byte, size int) error {
+	switch {
+	case len(payload) == size:
+		return nil
+	case len(payload) == 0:
+		return ErrEmptyPayload
+	case len(payload) < size:
+		return ErrPayloadTooSmall
+	default:
+		return ErrPayloadTooBig
+	}
+}
+
+// checkRequestSize checks that payload has size bytes, followed or not by a
+// handle.
+func checkRequestSize(payload []byte, size int) error {
+	if len(payload) == size+4 {
+		return nil
+	}
+	return checkSize(payload, size)
+}
+
+// getHandle returns the handle at the end of a request, or 0 if the request
+// is for the CONNECT file.
+func getHandle(b []byte) Handle {
+	if len(b) < 4 {
+		return 0
+	}
+	return Handle(binary.LittleEndian.Uint32(b))
+}
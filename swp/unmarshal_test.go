@@ -2,6 +2,7 @@ package swp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -16,7 +17,7 @@ func TestUnmarshal(t *testing.T) {
 	t.Run("UnknownMsg", func(t *testing.T) {
 		input := []byte{255}
 		_, err := Unmarshal(input)
-		if err != ErrUnknownMsg {
+		if !errors.Is(err, ErrUnknownMsg) {
 			t.Fatalf("expected %v, got %v", ErrUnknownMsg, err)
 		}
 	})
@@ -24,7 +25,7 @@ func TestUnmarshal(t *testing.T) {
 		t.Run("EmptyPayload", func(t *testing.T) {
 			input := []byte{byte(CONNECT)}
 			_, err := Unmarshal(input)
-			if err != ErrEmptyPayload {
+			if !errors.Is(err, ErrEmptyPayload) {
 				t.Fatalf("expected %v, got %v", ErrEmptyPayload, err)
 			}
 		})
@@ -60,7 +61,7 @@ func TestUnmarshal(t *testing.T) {
 		t.Run("EmptyPayload", func(t *testing.T) {
 			input := []byte{byte(GETCHUNK)}
 			_, err := Unmarshal(input)
-			if err != ErrEmptyPayload {
+			if !errors.Is(err, ErrEmptyPayload) {
 				t.Fatalf("expected %v, got %v", ErrEmptyPayload, err)
 			}
 		})
@@ -98,7 +99,7 @@ func TestUnmarshal(t *testing.T) {
 		t.Run("EmptyPayload", func(t *testing.T) {
 			input := []byte{byte(PIECE)}
 			_, err := Unmarshal(input)
-			if err != ErrEmptyPayload {
+			if !errors.Is(err, ErrEmptyPayload) {
 				t.Fatalf("expected %v, got %v", ErrEmptyPayload, err)
 			}
 		})
@@ -124,14 +125,14 @@ func TestUnmarshal(t *testing.T) {
 		t.Run("MissingNPieces", func(t *testing.T) {
 			input := []byte{byte(CHUNKINFO), 0, 0}
 			_, err := Unmarshal(input)
-			if err != ErrPayloadTooSmall {
+			if !errors.Is(err, ErrPayloadTooSmall) {
 				t.Fatalf("expected %v, got %v", ErrPayloadTooSmall, err)
 			}
 		})
 		t.Run("MissingChecksum", func(t *testing.T) {
 			input := []byte{byte(CHUNKINFO), 0, 0, 0, 0, 0, 0, 0, 0}
 			_, err := Unmarshal(input)
-			if err != ErrPayloadTooSmall {
+			if !errors.Is(err, ErrPayloadTooSmall) {
 				t.Fatalf("expected %v, got %v", ErrPayloadTooSmall, err)
 			}
 		})
@@ -162,6 +163,202 @@ func TestUnmarshal(t *testing.T) {
 			}
 		})
 	})
+	t.Run("Getchecksums", func(t *testing.T) {
+		t.Run("PayloadTooSmall", func(t *testing.T) {
+			input := []byte{byte(GETCHECKSUMS), 0, 0}
+			_, err := Unmarshal(input)
+			if !errors.Is(err, ErrPayloadTooSmall) {
+				t.Fatalf("expected %v, got %v", ErrPayloadTooSmall, err)
+			}
+		})
+		t.Run("Good", func(t *testing.T) {
+			var expected uint64 = 42
+			input := make([]byte, 1+8)
+			input[0] = byte(GETCHECKSUMS)
+			binary.LittleEndian.PutUint64(input[1:], expected)
+			msg, err := Unmarshal(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type() != GETCHECKSUMS {
+				t.Fatal("msg type not GETCHECKSUMS")
+			}
+			realMsg := msg.(Getchecksums)
+			if realMsg.Start != expected {
+				t.Fatalf("expected %v, got %v", expected, realMsg.Start)
+			}
+		})
+	})
+	t.Run("Checksums", func(t *testing.T) {
+		t.Run("MissingTotal", func(t *testing.T) {
+			input := []byte{byte(CHECKSUMS), 0, 0}
+			_, err := Unmarshal(input)
+			if !errors.Is(err, ErrPayloadTooSmall) {
+				t.Fatalf("expected %v, got %v", ErrPayloadTooSmall, err)
+			}
+		})
+		t.Run("PartialChecksum", func(t *testing.T) {
+			input := make([]byte, 1+8+3)
+			input[0] = byte(CHECKSUMS)
+			_, err := Unmarshal(input)
+			if !errors.Is(err, ErrPayloadTooSmall) {
+				t.Fatalf("expected %v, got %v", ErrPayloadTooSmall, err)
+			}
+		})
+		t.Run("Good", func(t *testing.T) {
+			expected := []uint64{1234, 5678}
+			input := make([]byte, 1+8+8*len(expected))
+			input[0] = byte(CHECKSUMS)
+			binary.LittleEndian.PutUint64(input[1:], 7)
+			for i := range expected {
+				binary.LittleEndian.PutUint64(input[9+8*i:], expected[i])
+			}
+			msg, err := Unmarshal(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type() != CHECKSUMS {
+				t.Fatal("msg type not CHECKSUMS")
+			}
+			realMsg := msg.(Checksums)
+			if realMsg.Total != 7 {
+				t.Fatalf("expected %v, got %v", 7, realMsg.Total)
+			}
+			if len(realMsg.Checksums) != len(expected) {
+				t.Fatalf("expected %v, got %v", expected, realMsg.Checksums)
+			}
+			for i := range expected {
+				if realMsg.Checksums[i] != expected[i] {
+					t.Fatalf("expected %v, got %v", expected, realMsg.Checksums)
+				}
+			}
+		})
+	})
+	t.Run("Hello", func(t *testing.T) {
+		t.Run("PayloadTooSmall", func(t *testing.T) {
+			input := []byte{byte(HELLO), 1, 0}
+			_, err := Unmarshal(input)
+			if !errors.Is(err, ErrPayloadTooSmall) {
+				t.Fatalf("expected %v, got %v", ErrPayloadTooSmall, err)
+			}
+		})
+		t.Run("Good", func(t *testing.T) {
+			expected := Hello{Version: 3, Caps: CapChecksums, MaxFrame: 1 << 20, Impl: "ezs"}
+			input := make([]byte, expected.Size())
+			if err := Marshal(expected, input); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := Unmarshal(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type() != HELLO {
+				t.Fatal("msg type not HELLO")
+			}
+			if realMsg := msg.(Hello); realMsg != expected {
+				t.Fatalf("expected %v, got %v", expected, realMsg)
+			}
+		})
+	})
+	t.Run("Error", func(t *testing.T) {
+		t.Run("PayloadTooSmall", func(t *testing.T) {
+			input := []byte{byte(ERROR), 1}
+			_, err := Unmarshal(input)
+			if !errors.Is(err, ErrPayloadTooSmall) {
+				t.Fatalf("expected %v, got %v", ErrPayloadTooSmall, err)
+			}
+		})
+		t.Run("Good", func(t *testing.T) {
+			expected := Error{Code: ERR_OUT_OF_RANGE, Text: "chunk 7 out of 3"}
+			input := make([]byte, expected.Size())
+			if err := Marshal(expected, input); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := Unmarshal(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type() != ERROR {
+				t.Fatal("msg type not ERROR")
+			}
+			if realMsg := msg.(Error); realMsg != expected {
+				t.Fatalf("expected %v, got %v", expected, realMsg)
+			}
+		})
+	})
+	t.Run("Getrange", func(t *testing.T) {
+		t.Run("PayloadTooSmall", func(t *testing.T) {
+			input := []byte{byte(GETRANGE), 1, 2, 3, 4, 5, 6, 7, 8}
+			_, err := Unmarshal(input)
+			if !errors.Is(err, ErrPayloadTooSmall) {
+				t.Fatalf("expected %v, got %v", ErrPayloadTooSmall, err)
+			}
+		})
+		t.Run("Good", func(t *testing.T) {
+			expected := Getrange{Offset: 1 << 40, Length: 4096}
+			input := make([]byte, expected.Size())
+			if err := Marshal(expected, input); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := Unmarshal(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type() != GETRANGE {
+				t.Fatal("msg type not GETRANGE")
+			}
+			if realMsg := msg.(Getrange); realMsg != expected {
+				t.Fatalf("expected %v, got %v", expected, realMsg)
+			}
+		})
+		t.Run("Handle", func(t *testing.T) {
+			expected := Getrange{Offset: 1 << 40, Length: 4096, Handle: 7}
+			input := make([]byte, expected.Size())
+			if err := Marshal(expected, input); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := Unmarshal(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if realMsg := msg.(Getrange); realMsg != expected {
+				t.Fatalf("expected %v, got %v", expected, realMsg)
+			}
+		})
+	})
+	t.Run("Handles", func(t *testing.T) {
+		msgs := []Msg{
+			Getchunk{Index: 3},
+			Getchunk{Index: 3, Handle: 1},
+			Getchecksums{Start: 1000, Handle: 1 << 31},
+			Open{Id: "id0"},
+			Opened{Handle: 42},
+			Close{Handle: 42},
+			Ping{Seq: 7},
+			Pong{Seq: 7},
+			Cancel{},
+		}
+		for _, expected := range msgs {
+			input := make([]byte, expected.Size())
+			if err := Marshal(expected, input); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := Unmarshal(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg != expected {
+				t.Fatalf("expected %v, got %v", expected, msg)
+			}
+		}
+	})
+	t.Run("Close", func(t *testing.T) {
+		input := []byte{byte(CLOSE), 1, 2}
+		_, err := Unmarshal(input)
+		if !errors.Is(err, ErrPayloadTooSmall) {
+			t.Fatalf("expected %v, got %v", ErrPayloadTooSmall, err)
+		}
+	})
 }
 
 func compareByteSlice(l, r []byte) error {